@@ -2,8 +2,10 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/ZaninAndrea/binder-server/internal/log"
@@ -30,10 +32,22 @@ func main() {
 	db := mongo.Connect(mongoUri, mongoDatabase)
 	defer db.Disconnect()
 
+	// Bring the database up to date with the current models
+	if err := db.EnsureIndexes(); err != nil {
+		mainLogger.Error(err)
+		panic(err)
+	}
+	if err := db.MigrateEmbeddedCards(); err != nil {
+		mainLogger.Error(err)
+		panic(err)
+	}
+	if err := db.MigrateCardMedia(rest.CardMedia); err != nil {
+		mainLogger.Error(err)
+		panic(err)
+	}
+
 	// Setup the Blob Storage
-	storageAccount := os.Getenv("BLOB_STORAGE_ACCOUNT")
-	storageKey := os.Getenv("BLOB_STORAGE_KEY")
-	imagesStorage, err := storage.NewBlobStorage(storageAccount, storageKey, "images")
+	imagesStorage, err := setupStorage("images")
 	if err != nil {
 		mainLogger.Error(err)
 		panic(err)
@@ -51,6 +65,19 @@ func main() {
 	}))
 	rest.SetupRoutes(router, db, imagesStorage)
 
+	// Permanently delete the trashed decks and cards once they expire
+	go rest.PurgeExpiredTrash(db, imagesStorage)
+
+	// Delete the data exports once they cannot be downloaded anymore
+	go rest.PurgeExpiredDataExports(db, imagesStorage)
+
+	// The local storage backend has no server of its own, so
+	// the blobs are served directly by the HTTP server
+	if localStorage, ok := imagesStorage.(*storage.LocalBlobStorage); ok {
+		handler := http.StripPrefix("/blobs", localStorage.Handler())
+		router.GET("/blobs/*filename", gin.WrapH(handler))
+	}
+
 	// Serving the .well-known route to allow automatic
 	// Let's Encrypt certificate renewal
 	router.Static("/.well-known", "./.well-known")
@@ -77,7 +104,7 @@ func main() {
 		}
 
 		go (func() {
-			mainLogger.Info("Listening on %s", s.Addr)
+			mainLogger.Infof("Listening on %s", s.Addr)
 			if err := s.ListenAndServeTLS("", ""); err != nil {
 				mainLogger.Error(err)
 			}
@@ -89,3 +116,29 @@ func main() {
 		panic(err)
 	}
 }
+
+// setupStorage creates the blob storage backend selected by the
+// STORAGE_BACKEND environment variable, which defaults to Azure
+func setupStorage(containerName string) (storage.BlobStorage, error) {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "", "azure":
+		storageAccount := os.Getenv("BLOB_STORAGE_ACCOUNT")
+		storageKey := os.Getenv("BLOB_STORAGE_KEY")
+		return storage.NewAzureBlobStorage(storageAccount, storageKey, containerName)
+	case "local":
+		directory := filepath.Join(os.Getenv("LOCAL_STORAGE_PATH"), containerName)
+		baseURL := os.Getenv("LOCAL_STORAGE_URL") + "/blobs"
+		secret := []byte(os.Getenv("JWT_SECRET"))
+		return storage.NewLocalBlobStorage(directory, baseURL, secret)
+	case "s3":
+		return storage.NewS3BlobStorage(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+			containerName,
+			os.Getenv("S3_USE_SSL") != "false",
+		)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", os.Getenv("STORAGE_BACKEND"))
+	}
+}
@@ -0,0 +1,297 @@
+package anki
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportedModelID is the ID of the note type used by the exported notes
+const ExportedModelID = 1342697561419
+
+const schema = `
+CREATE TABLE col (id integer primary key, crt integer not null, mod integer not null, scm integer not null, ver integer not null, dty integer not null, usn integer not null, ls integer not null, conf text not null, models text not null, decks text not null, dconf text not null, tags text not null);
+CREATE TABLE notes (id integer primary key, guid text not null, mid integer not null, mod integer not null, usn integer not null, tags text not null, flds text not null, sfld integer not null, csum integer not null, flags integer not null, data text not null);
+CREATE TABLE cards (id integer primary key, nid integer not null, did integer not null, ord integer not null, mod integer not null, usn integer not null, type integer not null, queue integer not null, due integer not null, ivl integer not null, factor integer not null, reps integer not null, lapses integer not null, left integer not null, odue integer not null, odid integer not null, flags integer not null, data text not null);
+CREATE TABLE revlog (id integer primary key, cid integer not null, usn integer not null, ease integer not null, ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null, type integer not null);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
+
+// ExportReview is a repetition of an exported card, Ease is the
+// Anki answer button (1 again, 2 hard, 3 good, 4 easy)
+type ExportReview struct {
+	Date time.Time
+	Ease int
+}
+
+// ExportCard is a note with a single card, of a note type with the Front and Back fields
+type ExportCard struct {
+	DeckID    int64
+	GUID      string
+	Front     string
+	Back      string
+	Tags      []string
+	Suspended bool
+	// LastReview is nil for the cards that have never been studied
+	LastReview *time.Time
+	Interval   time.Duration
+	// Factor is the ease factor, e.g. 2.5
+	Factor  float32
+	Reviews []ExportReview
+	Lapses  int
+}
+
+// MediaFile is a file referenced by filename in the content of the cards
+type MediaFile struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+// WritePackage writes an Anki package containing the decks, the cards and the media
+func WritePackage(w io.Writer, decks []Deck, cards []ExportCard, media []MediaFile) error {
+	tmp, err := os.CreateTemp("", "binder-anki-*.sqlite")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = writeCollection(tmp.Name(), decks, cards)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	collection, err := archive.Create("collection.anki2")
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(collection, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// The media files are stored with numeric names, mapped to the filenames by the media file
+	names := map[string]string{}
+	for i, mediaFile := range media {
+		entry := strconv.Itoa(i)
+		names[entry] = mediaFile.Name
+
+		writer, err := archive.Create(entry)
+		if err != nil {
+			return err
+		}
+		reader, err := mediaFile.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	mediaWriter, err := archive.Create("media")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(mediaWriter).Encode(names)
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeCollection(path string, decks []Deck, cards []ExportCard) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	creation := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(-1, 0, 0)
+	_, err = tx.Exec(
+		"INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')",
+		creation.Unix(), now.UnixMilli(), now.UnixMilli(),
+		collectionConf, modelsJSON(now), decksJSON(decks, now), deckConfJSON,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The IDs are millisecond timestamps in Anki, so they are generated from the current time
+	nextId := now.UnixMilli()
+	usedReviewIds := map[int64]bool{}
+	for position, card := range cards {
+		noteId := nextId
+		cardId := nextId + 1
+		nextId += 2
+
+		sortField := StripHTML(card.Front)
+		checksum := sha1.Sum([]byte(sortField))
+		csum, _ := strconv.ParseInt(hex.EncodeToString(checksum[:4]), 16, 64)
+		tags := ""
+		if len(card.Tags) > 0 {
+			tags = " " + strings.Join(card.Tags, " ") + " "
+		}
+		_, err := tx.Exec(
+			"INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')",
+			noteId, card.GUID, ExportedModelID, now.Unix(), tags,
+			card.Front+FieldSeparator+card.Back, sortField, csum,
+		)
+		if err != nil {
+			return err
+		}
+
+		// The new cards are due by position, the studied ones by day
+		cardType, queue, due, interval, factor := 0, 0, position, 0, 2500
+		if card.LastReview != nil {
+			interval = int(math.Max(1, math.Round(card.Interval.Hours()/24)))
+			dueDate := card.LastReview.Add(card.Interval)
+			cardType, queue, due = 2, 2, int(dueDate.Sub(creation).Hours()/24)
+			factor = int(card.Factor * 1000)
+		}
+		if card.Suspended {
+			queue = QueueSuspended
+		}
+		_, err = tx.Exec(
+			"INSERT INTO cards VALUES (?, ?, ?, 0, ?, -1, ?, ?, ?, ?, ?, ?, ?, 0, 0, 0, 0, '')",
+			cardId, noteId, card.DeckID, now.Unix(), cardType, queue, due, interval, factor,
+			len(card.Reviews), card.Lapses,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, review := range card.Reviews {
+			reviewId := review.Date.UnixMilli()
+			for usedReviewIds[reviewId] {
+				reviewId++
+			}
+			usedReviewIds[reviewId] = true
+
+			_, err = tx.Exec(
+				"INSERT INTO revlog VALUES (?, ?, -1, ?, 0, 0, ?, 0, 1)",
+				reviewId, cardId, review.Ease, factor,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+const collectionConf = `{"activeDecks":[1],"curDeck":1,"newSpread":0,"collapseTime":1200,"timeLim":0,"estTimes":true,"dueCounts":true,"curModel":null,"nextPos":1,"sortType":"noteFld","sortBackwards":false,"addToCur":true}`
+
+const deckConfJSON = `{"1":{"id":1,"name":"Default","autoplay":true,"dyn":false,"maxTaken":60,"mod":0,"replayq":true,"timer":0,"usn":0,` +
+	`"new":{"bury":true,"delays":[1,10],"initialFactor":2500,"ints":[1,4,7],"order":1,"perDay":20,"separate":true},` +
+	`"lapse":{"delays":[10],"leechAction":0,"leechFails":8,"minInt":1,"mult":0},` +
+	`"rev":{"bury":true,"ease4":1.3,"fuzz":0.05,"ivlFct":1,"maxIvl":36500,"minSpace":1,"perDay":100}}}`
+
+func decksJSON(decks []Deck, now time.Time) string {
+	all := append([]Deck{{ID: 1, Name: "Default"}}, decks...)
+
+	result := map[string]interface{}{}
+	for _, deck := range all {
+		result[strconv.FormatInt(deck.ID, 10)] = map[string]interface{}{
+			"id":               deck.ID,
+			"name":             deck.Name,
+			"desc":             "",
+			"conf":             1,
+			"dyn":              0,
+			"collapsed":        false,
+			"extendNew":        10,
+			"extendRev":        50,
+			"mod":              now.Unix(),
+			"usn":              -1,
+			"newToday":         []int{0, 0},
+			"revToday":         []int{0, 0},
+			"lrnToday":         []int{0, 0},
+			"timeToday":        []int{0, 0},
+			"browserCollapsed": false,
+		}
+	}
+
+	raw, _ := json.Marshal(result)
+	return string(raw)
+}
+
+func modelsJSON(now time.Time) string {
+	field := func(name string, ord int) map[string]interface{} {
+		return map[string]interface{}{
+			"name":   name,
+			"ord":    ord,
+			"font":   "Arial",
+			"size":   20,
+			"media":  []string{},
+			"rtl":    false,
+			"sticky": false,
+		}
+	}
+
+	model := map[string]interface{}{
+		"id":        ExportedModelID,
+		"name":      "Binder Basic",
+		"type":      StandardModel,
+		"mod":       now.Unix(),
+		"usn":       -1,
+		"sortf":     0,
+		"did":       1,
+		"tags":      []string{},
+		"vers":      []int{},
+		"req":       []interface{}{[]interface{}{0, "all", []int{0}}},
+		"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+		"latexPost": "\\end{document}",
+		"css":       ".card {\n font-family: arial;\n font-size: 20px;\n text-align: center;\n color: black;\n background-color: white;\n}\n",
+		"flds":      []interface{}{field("Front", 0), field("Back", 1)},
+		"tmpls": []interface{}{map[string]interface{}{
+			"name":  "Card 1",
+			"ord":   0,
+			"qfmt":  "{{Front}}",
+			"afmt":  "{{FrontSide}}\n\n<hr id=answer>\n\n{{Back}}",
+			"bqfmt": "",
+			"bafmt": "",
+			"did":   nil,
+		}},
+	}
+
+	raw, _ := json.Marshal(map[string]interface{}{
+		strconv.FormatInt(ExportedModelID, 10): model,
+	})
+	return string(raw)
+}
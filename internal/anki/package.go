@@ -0,0 +1,338 @@
+// Package anki reads and writes Anki deck packages (.apkg), which are zip
+// archives containing an SQLite collection and the media files
+package anki
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+var ErrInvalidPackage error = fmt.Errorf("the file is not a valid Anki package")
+var ErrEntryTooLarge error = fmt.Errorf("the Anki package contains a file that is too large")
+var ErrUnsupportedPackage error = fmt.Errorf("the Anki package uses an unsupported format, export it with the \"Support older Anki versions\" option")
+
+// FieldSeparator separates the fields of a note in the flds column
+const FieldSeparator = "\x1f"
+
+// Card queues and types with a special meaning
+const (
+	QueueSuspended = -1
+	// ReviewManual is the type of the revlog entries created when a card is rescheduled by hand
+	ReviewManual = 4
+)
+
+type Deck struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// Path returns the names of the deck and of its ancestors, from the top-level one
+func (d Deck) Path() []string {
+	return strings.Split(d.Name, "::")
+}
+
+type Field struct {
+	Name string `json:"name"`
+	Ord  int    `json:"ord"`
+}
+
+type Template struct {
+	Name           string `json:"name"`
+	Ord            int    `json:"ord"`
+	QuestionFormat string `json:"qfmt"`
+	AnswerFormat   string `json:"afmt"`
+}
+
+// Note types
+const (
+	StandardModel = 0
+	ClozeModel    = 1
+)
+
+// Model is a note type, it defines the fields of the notes and the
+// templates used to generate their cards
+type Model struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Type      int        `json:"type"`
+	Fields    []Field    `json:"flds"`
+	Templates []Template `json:"tmpls"`
+	CSS       string     `json:"css"`
+}
+
+type Note struct {
+	ID      int64
+	GUID    string
+	ModelID int64
+	Tags    []string
+	Fields  []string
+}
+
+type Card struct {
+	ID     int64
+	NoteID int64
+	DeckID int64
+	Ord    int
+	Queue  int
+}
+
+// Review is an entry of the review log, the ID is the timestamp
+// of the review in milliseconds
+type Review struct {
+	ID     int64
+	CardID int64
+	Ease   int
+	Type   int
+}
+
+// Package is an Anki package whose collection has been extracted to a
+// temporary file, it must be closed to release the temporary files
+type Package struct {
+	archive        *zip.ReadCloser
+	collectionPath string
+	db             *sql.DB
+	media          map[string]*zip.File
+	maxEntrySize   uint64
+}
+
+// Open reads the Anki package stored at the given path, the files of the
+// package larger than maxEntrySize bytes once decompressed are rejected
+func Open(path string, maxEntrySize uint64) (*Package, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, ErrInvalidPackage
+	}
+
+	pkg := &Package{
+		archive:      archive,
+		media:        map[string]*zip.File{},
+		maxEntrySize: maxEntrySize,
+	}
+	if err := pkg.load(); err != nil {
+		pkg.Close()
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+func (p *Package) load() error {
+	entries := map[string]*zip.File{}
+	for _, file := range p.archive.File {
+		entries[file.Name] = file
+	}
+
+	// The newer collection format is a compressed database with a different schema
+	collection, ok := entries["collection.anki21"]
+	if !ok {
+		if _, ok := entries["collection.anki21b"]; ok {
+			return ErrUnsupportedPackage
+		}
+
+		collection, ok = entries["collection.anki2"]
+		if !ok {
+			return ErrInvalidPackage
+		}
+	}
+
+	// SQLite needs a file on disk
+	tmp, err := os.CreateTemp("", "binder-anki-*.sqlite")
+	if err != nil {
+		return err
+	}
+	p.collectionPath = tmp.Name()
+
+	// The zip reader fails if the entry decompresses to more than its declared size
+	if collection.UncompressedSize64 > p.maxEntrySize {
+		tmp.Close()
+		return ErrEntryTooLarge
+	}
+	reader, err := collection.Open()
+	if err != nil {
+		tmp.Close()
+		return ErrInvalidPackage
+	}
+	_, err = io.Copy(tmp, reader)
+	reader.Close()
+	tmp.Close()
+	if err != nil {
+		return ErrInvalidPackage
+	}
+
+	p.db, err = sql.Open("sqlite", "file:"+p.collectionPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+
+	// The media file maps the numeric names of the zip entries to the original filenames
+	if mediaFile, ok := entries["media"]; ok {
+		if mediaFile.UncompressedSize64 > p.maxEntrySize {
+			return ErrEntryTooLarge
+		}
+		reader, err := mediaFile.Open()
+		if err != nil {
+			return ErrInvalidPackage
+		}
+		defer reader.Close()
+
+		names := map[string]string{}
+		if err := json.NewDecoder(reader).Decode(&names); err != nil {
+			return ErrInvalidPackage
+		}
+		for entry, name := range names {
+			if file, ok := entries[entry]; ok {
+				p.media[name] = file
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close releases the archive and deletes the temporary files
+func (p *Package) Close() error {
+	if p.db != nil {
+		p.db.Close()
+	}
+	if p.collectionPath != "" {
+		os.Remove(p.collectionPath)
+	}
+
+	return p.archive.Close()
+}
+
+// Decks returns the decks defined in the collection
+func (p *Package) Decks() ([]Deck, error) {
+	var raw string
+	err := p.db.QueryRow("SELECT decks FROM col").Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	decksById := map[string]Deck{}
+	if err := json.Unmarshal([]byte(raw), &decksById); err != nil {
+		return nil, ErrInvalidPackage
+	}
+
+	decks := make([]Deck, 0, len(decksById))
+	for _, deck := range decksById {
+		decks = append(decks, deck)
+	}
+
+	return decks, nil
+}
+
+// Models returns the note types defined in the collection, indexed by ID
+func (p *Package) Models() (map[int64]Model, error) {
+	var raw string
+	err := p.db.QueryRow("SELECT models FROM col").Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	modelsById := map[string]Model{}
+	if err := json.Unmarshal([]byte(raw), &modelsById); err != nil {
+		return nil, ErrInvalidPackage
+	}
+
+	models := map[int64]Model{}
+	for rawId, model := range modelsById {
+		id, err := strconv.ParseInt(rawId, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidPackage
+		}
+		model.ID = id
+		models[id] = model
+	}
+
+	return models, nil
+}
+
+// Notes returns the notes of the collection, indexed by ID
+func (p *Package) Notes() (map[int64]Note, error) {
+	rows, err := p.db.Query("SELECT id, guid, mid, tags, flds FROM notes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := map[int64]Note{}
+	for rows.Next() {
+		var note Note
+		var tags, fields string
+		err := rows.Scan(&note.ID, &note.GUID, &note.ModelID, &tags, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		note.Tags = strings.Fields(tags)
+		note.Fields = strings.Split(fields, FieldSeparator)
+		notes[note.ID] = note
+	}
+
+	return notes, rows.Err()
+}
+
+// Cards returns the cards of the collection
+func (p *Package) Cards() ([]Card, error) {
+	rows, err := p.db.Query("SELECT id, nid, did, ord, queue FROM cards ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []Card{}
+	for rows.Next() {
+		var card Card
+		err := rows.Scan(&card.ID, &card.NoteID, &card.DeckID, &card.Ord, &card.Queue)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+
+	return cards, rows.Err()
+}
+
+// Reviews returns the review log of the collection in chronological order
+func (p *Package) Reviews() ([]Review, error) {
+	rows, err := p.db.Query("SELECT id, cid, ease, type FROM revlog ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(&review.ID, &review.CardID, &review.Ease, &review.Type)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+// OpenMedia opens the media file with the given filename, the boolean
+// is false if the package does not contain the file
+func (p *Package) OpenMedia(name string) (io.ReadCloser, bool, error) {
+	file, ok := p.media[name]
+	if !ok {
+		return nil, false, nil
+	} else if file.UncompressedSize64 > p.maxEntrySize {
+		return nil, true, ErrEntryTooLarge
+	}
+
+	reader, err := file.Open()
+	return reader, true, err
+}
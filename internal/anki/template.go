@@ -0,0 +1,152 @@
+package anki
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidTemplate error = fmt.Errorf("the Anki package contains an invalid card template")
+
+var tagRegex = regexp.MustCompile(`{{\s*([#^/]?)\s*([^}]*?)\s*}}`)
+var clozeRegex = regexp.MustCompile(`(?s){{c(\d+)::(.*?)(?:::(.*?))?}}`)
+var htmlTagRegex = regexp.MustCompile(`(?s)<[^>]*>`)
+var answerSeparatorRegex = regexp.MustCompile(`^\s*<hr id=["']?answer["']?>`)
+
+// Render returns the question and the answer of the card generated by the
+// note with the template (or cloze number for cloze notes) with the given ord.
+// The answer does not repeat the question, since the two are shown separately
+func (m Model) Render(note Note, ord int) (string, string, error) {
+	fields := map[string]string{}
+	for i, field := range m.Fields {
+		if i < len(note.Fields) {
+			fields[field.Name] = note.Fields[i]
+		}
+	}
+	fields["Tags"] = strings.Join(note.Tags, " ")
+	fields["Type"] = m.Name
+
+	var template *Template
+	for i := range m.Templates {
+		if m.Type == ClozeModel || m.Templates[i].Ord == ord {
+			template = &m.Templates[i]
+			break
+		}
+	}
+	if template == nil {
+		return "", "", fmt.Errorf("%w: the note type %q has no template %d", ErrInvalidTemplate, m.Name, ord)
+	}
+
+	question, err := renderTemplate(template.QuestionFormat, fields, ord, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	fields["FrontSide"] = ""
+	answer, err := renderTemplate(template.AnswerFormat, fields, ord, true)
+	if err != nil {
+		return "", "", err
+	}
+	answer = answerSeparatorRegex.ReplaceAllString(answer, "")
+
+	return strings.TrimSpace(question), strings.TrimSpace(answer), nil
+}
+
+// renderTemplate replaces the fields and the conditional sections of the template
+func renderTemplate(template string, fields map[string]string, ord int, answer bool) (string, error) {
+	var output strings.Builder
+
+	// The sections that are being skipped, since their condition is false
+	type section struct {
+		name string
+		skip bool
+	}
+	sections := []section{}
+	skipping := func() bool {
+		for _, s := range sections {
+			if s.skip {
+				return true
+			}
+		}
+		return false
+	}
+
+	position := 0
+	for _, match := range tagRegex.FindAllStringSubmatchIndex(template, -1) {
+		if !skipping() {
+			output.WriteString(template[position:match[0]])
+		}
+		position = match[1]
+
+		kind := template[match[2]:match[3]]
+		name := template[match[4]:match[5]]
+		switch kind {
+		case "#", "^":
+			empty := strings.TrimSpace(StripHTML(fields[name])) == ""
+			sections = append(sections, section{name: name, skip: empty == (kind == "#")})
+		case "/":
+			if len(sections) == 0 || sections[len(sections)-1].name != name {
+				return "", fmt.Errorf("%w: unexpected closing tag for the section %q", ErrInvalidTemplate, name)
+			}
+			sections = sections[:len(sections)-1]
+		default:
+			if !skipping() {
+				output.WriteString(renderField(name, fields, ord, answer))
+			}
+		}
+	}
+	if len(sections) > 0 {
+		return "", fmt.Errorf("%w: the section %q is not closed", ErrInvalidTemplate, sections[len(sections)-1].name)
+	}
+	output.WriteString(template[position:])
+
+	return output.String(), nil
+}
+
+// renderField returns the value of a field reference, which may
+// be prefixed by filters (e.g. "text:Front" or "cloze:Text")
+func renderField(reference string, fields map[string]string, ord int, answer bool) string {
+	parts := strings.Split(reference, ":")
+	name := parts[len(parts)-1]
+	value := fields[name]
+
+	for i := len(parts) - 2; i >= 0; i-- {
+		switch strings.TrimSpace(parts[i]) {
+		case "text":
+			value = StripHTML(value)
+		case "cloze":
+			value = renderCloze(value, ord+1, answer)
+		case "type":
+			// There is no typing in the answers
+			value = ""
+		}
+	}
+
+	return value
+}
+
+// renderCloze hides the deletion with the given number in the question
+// and highlights it in the answer, the other deletions are shown as text
+func renderCloze(content string, number int, answer bool) string {
+	return clozeRegex.ReplaceAllStringFunc(content, func(match string) string {
+		groups := clozeRegex.FindStringSubmatch(match)
+		deletion, _ := strconv.Atoi(groups[1])
+		text, hint := groups[2], groups[3]
+
+		if deletion != number {
+			return text
+		} else if answer {
+			return `<span class="cloze">` + text + `</span>`
+		} else if hint != "" {
+			return `<span class="cloze">[` + hint + `]</span>`
+		}
+		return `<span class="cloze">[...]</span>`
+	})
+}
+
+// StripHTML removes the tags from the HTML content and decodes the entities
+func StripHTML(content string) string {
+	return html.UnescapeString(htmlTagRegex.ReplaceAllString(content, ""))
+}
@@ -0,0 +1,176 @@
+// Package cardtext parses and writes cards authored as plain text or Markdown.
+//
+// A card starts with a "Q:" line, whose back starts at the following "A:" line,
+// or with a Markdown heading, whose back is the text below it. Lines containing
+// only "---" separate the cards: a block without markers is a card whose front
+// is its first paragraph. A "Tags:" line in the back sets the comma separated
+// tags of the card.
+package cardtext
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+var separatorRegex = regexp.MustCompile(`^\s*-{3,}\s*$`)
+var headingRegex = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+var fenceRegex = regexp.MustCompile("^\\s*(```|~~~)")
+
+// Card is a card parsed from the text, Line is the line where it starts.
+// The front and the back are in Markdown
+type Card struct {
+	Line  int
+	Front string
+	Back  string
+	Tags  []string
+}
+
+// card styles
+const (
+	styleQuestion = iota
+	styleHeading
+	stylePlain
+)
+
+// Parse returns the cards written in the text, the empty ones are skipped
+func Parse(text string) []Card {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	cards := []Card{}
+	var current *Card
+	var style int
+	var front, back []string
+	inBack := false
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+
+		current.Front = strings.TrimSpace(strings.Join(front, "\n"))
+		current.Back = strings.TrimSpace(strings.Join(back, "\n"))
+		if current.Front != "" || current.Back != "" {
+			cards = append(cards, *current)
+		}
+		current, front, back, inBack = nil, nil, nil, false
+	}
+	start := func(line int, cardStyle int) {
+		flush()
+		current = &Card{Line: line, Tags: []string{}}
+		style = cardStyle
+	}
+	appendLine := func(line string) {
+		if inBack {
+			back = append(back, line)
+		} else {
+			front = append(front, line)
+		}
+	}
+
+	inFence := false
+	for i, line := range strings.Split(text, "\n") {
+		lineNumber := i + 1
+
+		// The markers are not recognized inside code blocks
+		if fence := fenceRegex.MatchString(line); fence || inFence {
+			if fence {
+				inFence = !inFence
+			}
+			if current == nil {
+				start(lineNumber, stylePlain)
+			}
+			appendLine(line)
+			continue
+		}
+
+		if separatorRegex.MatchString(line) {
+			flush()
+		} else if value, ok := cutMarker(line, "Q:"); ok {
+			start(lineNumber, styleQuestion)
+			front = append(front, value)
+		} else if value, ok := cutMarker(line, "A:"); ok && current != nil && style == styleQuestion && !inBack {
+			inBack = true
+			back = append(back, value)
+		} else if match := headingRegex.FindStringSubmatch(line); match != nil && (current == nil || style != styleQuestion) {
+			start(lineNumber, styleHeading)
+			front = append(front, match[1])
+			inBack = true
+		} else if value, ok := cutMarker(line, "Tags:"); ok && current != nil && inBack {
+			for _, tag := range strings.Split(value, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					current.Tags = append(current.Tags, tag)
+				}
+			}
+		} else if current == nil {
+			if strings.TrimSpace(line) != "" {
+				start(lineNumber, stylePlain)
+				front = append(front, line)
+			}
+		} else if style == stylePlain && !inBack && strings.TrimSpace(line) == "" {
+			// The first paragraph of a block without markers is the front
+			inBack = true
+		} else {
+			appendLine(line)
+		}
+	}
+	flush()
+
+	return cards
+}
+
+// cutMarker returns the rest of the line if it starts with the case insensitive marker
+func cutMarker(line string, marker string) (string, bool) {
+	if len(line) < len(marker) || !strings.EqualFold(line[:len(marker)], marker) {
+		return "", false
+	}
+
+	return strings.TrimSpace(line[len(marker):]), true
+}
+
+// Format writes the cards with the Q:/A: markers, so that they can be parsed back
+func Format(cards []Card) string {
+	var b strings.Builder
+	for i, card := range cards {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		b.WriteString(formatField("Q:", card.Front))
+		b.WriteString(formatField("A:", card.Back))
+		if len(card.Tags) > 0 {
+			b.WriteString("Tags: " + strings.Join(card.Tags, ", ") + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// formatField writes the marker followed by the content, the content spanning
+// multiple lines starts on a new line so that code blocks are not broken
+func formatField(marker string, content string) string {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return marker + "\n"
+	} else if strings.Contains(content, "\n") {
+		return marker + "\n" + content + "\n"
+	}
+
+	return marker + " " + content + "\n"
+}
+
+// markdown renders the raw HTML too, since cards exported from Binder contain HTML
+var markdown = goldmark.New(goldmark.WithRendererOptions(html.WithUnsafe()))
+
+// RenderMarkdown converts the Markdown content of a card to HTML
+func RenderMarkdown(content string) (string, error) {
+	var b bytes.Buffer
+	if err := markdown.Convert([]byte(content), &b); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
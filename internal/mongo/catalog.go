@@ -0,0 +1,93 @@
+package mongo
+
+import (
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	op "github.com/ZaninAndrea/binder-server/internal/mongo/op"
+)
+
+// CatalogEntry is the public representation of a published deck,
+// the card count includes the cards of all the sub-decks
+type CatalogEntry struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description" json:"description"`
+	PublishedAt *time.Time         `bson:"publishedAt" json:"publishedAt"`
+	UpdatedAt   time.Time          `bson:"updatedAt" json:"updatedAt"`
+	Subscribers int                `bson:"subscribers" json:"subscribers"`
+	TotalCards  int                `bson:"totalCards" json:"totalCards"`
+}
+
+// CatalogQuery contains the options used to browse the public catalog
+type CatalogQuery struct {
+	// Search filters the decks whose name or description contain it
+	Search string
+	Limit  int
+	Offset int
+}
+
+// ListCatalog returns a page of the published decks matching the
+// query, the most subscribed decks are returned first
+func (db *Database) ListCatalog(query CatalogQuery) ([]*CatalogEntry, error) {
+	match := bson.M{
+		"published": true,
+	}
+	if query.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+		match[string(op.Or)] = bson.A{
+			bson.M{"name": pattern},
+			bson.M{"description": pattern},
+		}
+	}
+
+	pipeline := bson.A{
+		bson.M{string(op.Match): match},
+		bson.M{string(op.Sort): bson.D{
+			{Key: "subscribers", Value: -1},
+			{Key: "publishedAt", Value: -1},
+			{Key: "_id", Value: -1},
+		}},
+		bson.M{string(op.Skip): query.Offset},
+		bson.M{string(op.Limit): query.Limit},
+		bson.M{string(op.GraphLookup): bson.M{
+			"from":             "decks",
+			"startWith":        "$_id",
+			"connectFromField": "_id",
+			"connectToField":   "parent",
+			"as":               "descendants",
+		}},
+		bson.M{string(op.Lookup): bson.M{
+			"from": "cards",
+			"let": bson.M{"deckIds": bson.M{
+				string(op.ConcatArrays): bson.A{bson.A{"$_id"}, "$descendants._id"},
+			}},
+			"pipeline": bson.A{
+				bson.M{string(op.Match): bson.M{
+					string(op.Expr): bson.M{string(op.In): bson.A{"$deckId", "$$deckIds"}},
+				}},
+				bson.M{string(op.Count): "totalCards"},
+			},
+			"as": "statistics",
+		}},
+		bson.M{string(op.Project): bson.M{
+			"name":        1,
+			"description": 1,
+			"publishedAt": 1,
+			"updatedAt":   1,
+			"subscribers": 1,
+			"totalCards":  bson.M{string(op.IfNull): bson.A{bson.M{string(op.First): "$statistics.totalCards"}, 0}},
+		}},
+	}
+
+	entries := []*CatalogEntry{}
+	err := db.Decks.Aggregate(pipeline, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -51,6 +51,16 @@ func (c *Collection[Record]) InsertOne(document Record) (primitive.ObjectID, err
 	return res.InsertedID.(primitive.ObjectID), nil
 }
 
+// RestoreOne inserts the document keeping its ID and timestamps,
+// it is used to bring back documents that were removed
+func (c *Collection[Record]) RestoreOne(document Record) error {
+	ctx, cancel := c.GetTimeoutContext()
+	defer cancel()
+
+	_, err := c.collection.InsertOne(ctx, document)
+	return err
+}
+
 func (c *Collection[Record]) InsertMany(documents []Record) error {
 	ctx, cancel := c.GetTimeoutContext()
 
@@ -170,6 +180,18 @@ func (c *Collection[Record]) FindAll(filter interface{}, results *[]Record) erro
 	return cur.All(ctx, results)
 }
 
+func (c *Collection[Record]) Aggregate(pipeline interface{}, results interface{}) error {
+	ctx, cancel := c.GetTimeoutContext()
+	defer cancel()
+
+	cur, err := c.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+
+	return cur.All(ctx, results)
+}
+
 type UpdateDocument map[op.Operator]bson.M
 
 func (c *Collection[Record]) UpdateOne(filter interface{}, update UpdateDocument, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
@@ -52,9 +52,17 @@ func (db *basicDatabase) MongoDatabase() *mongo.Database {
 
 type Database struct {
 	basicDatabase
-	Users       Collection[*User]
-	Decks       Collection[*Deck]
-	Repetitions Collection[*Repetition]
+	Users         Collection[*User]
+	Decks         Collection[*Deck]
+	Cards         Collection[*Card]
+	Repetitions   Collection[*Repetition]
+	Schedules     Collection[*CardSchedule]
+	Blobs         Collection[*Blob]
+	Subscriptions Collection[*Subscription]
+	ShareLinks    Collection[*ShareLink]
+	DataExports   Collection[*DataExport]
+	DeckSnapshots Collection[*DeckSnapshot]
+	Trash         Collection[*TrashItem]
 }
 
 func Connect(mongoUri string, mongoDatabase string) *Database {
@@ -63,7 +71,15 @@ func Connect(mongoUri string, mongoDatabase string) *Database {
 
 	db.Users = NewCollection[*User](db, "users")
 	db.Decks = NewCollection[*Deck](db, "decks")
+	db.Cards = NewCollection[*Card](db, "cards")
 	db.Repetitions = NewCollection[*Repetition](db, "repetitions")
+	db.Schedules = NewCollection[*CardSchedule](db, "schedules")
+	db.Blobs = NewCollection[*Blob](db, "blobs")
+	db.Subscriptions = NewCollection[*Subscription](db, "subscriptions")
+	db.ShareLinks = NewCollection[*ShareLink](db, "shareLinks")
+	db.DataExports = NewCollection[*DataExport](db, "dataExports")
+	db.DeckSnapshots = NewCollection[*DeckSnapshot](db, "deckSnapshots")
+	db.Trash = NewCollection[*TrashItem](db, "trash")
 
 	return db
 }
@@ -74,7 +90,15 @@ func copy(ctx context.Context, db *Database) *Database {
 
 	newDB.Users = NewCollection[*User](&newDB, "users")
 	newDB.Decks = NewCollection[*Deck](&newDB, "decks")
+	newDB.Cards = NewCollection[*Card](&newDB, "cards")
 	newDB.Repetitions = NewCollection[*Repetition](&newDB, "repetitions")
+	newDB.Schedules = NewCollection[*CardSchedule](&newDB, "schedules")
+	newDB.Blobs = NewCollection[*Blob](&newDB, "blobs")
+	newDB.Subscriptions = NewCollection[*Subscription](&newDB, "subscriptions")
+	newDB.ShareLinks = NewCollection[*ShareLink](&newDB, "shareLinks")
+	newDB.DataExports = NewCollection[*DataExport](&newDB, "dataExports")
+	newDB.DeckSnapshots = NewCollection[*DeckSnapshot](&newDB, "deckSnapshots")
+	newDB.Trash = NewCollection[*TrashItem](&newDB, "trash")
 
 	return &newDB
 }
@@ -0,0 +1,245 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	op "github.com/ZaninAndrea/binder-server/internal/mongo/op"
+)
+
+// EnsureIndexes creates the indexes used by the most frequent queries,
+// indexes that already exist are left untouched
+func (db *Database) EnsureIndexes() error {
+	ctx, cancel := db.Cards.GetTimeoutContext()
+	defer cancel()
+
+	_, err := db.Cards.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "deckId", Value: 1}, {Key: "id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Repetitions.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "deckId", Value: 1}, {Key: "cardId", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Schedules.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "deckId", Value: 1}, {Key: "cardId", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Decks.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "collaborators.user", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Decks.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "published", Value: 1}, {Key: "subscribers", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Subscriptions.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user", Value: 1}, {Key: "deck", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ShareLinks.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tokenHash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DataExports.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user", Value: 1}, {Key: "createdAt", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DeckSnapshots.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "deck", Value: 1}, {Key: "createdAt", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DeckSnapshots.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "media", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Trash.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "owner", Value: 1}, {Key: "createdAt", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Trash.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "expiresAt", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Cards.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "media", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Trash.Collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "card.media", Value: 1}},
+	})
+	return err
+}
+
+// legacyDeck is the shape of the decks that still embed their cards
+type legacyDeck struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Cards []*Card            `bson:"cards"`
+}
+
+// MigrateEmbeddedCards moves the cards embedded in the decks documents
+// to the cards collection, the migration is idempotent and each deck
+// is migrated in its own transaction
+func (db *Database) MigrateEmbeddedCards() error {
+	ctx, cancel := db.Decks.GetTimeoutContext()
+	defer cancel()
+
+	cur, err := db.Decks.Collection().Find(ctx, bson.M{
+		"cards": bson.M{
+			string(op.Exists): true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	decks := []*legacyDeck{}
+	if err := cur.All(ctx, &decks); err != nil {
+		return err
+	}
+
+	for _, deck := range decks {
+		_, err := db.Transaction(
+			30*time.Second,
+			func(db *Database, s SessionContext) (any, error) {
+				if len(deck.Cards) > 0 {
+					for _, card := range deck.Cards {
+						card.DeckID = deck.ID
+					}
+
+					err := db.Cards.InsertMany(deck.Cards)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				_, err := db.Decks.UpdateById(deck.ID, UpdateDocument{
+					op.Unset: bson.M{
+						"cards": "",
+					},
+				})
+				return nil, err
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateCardMedia fills the media field of the cards and of the trashed cards
+// that were saved before it was introduced, cardMedia returns the IDs of the
+// blobs referenced by a card. The migration is idempotent
+func (db *Database) MigrateCardMedia(cardMedia func(card Card) []string) error {
+	// The cursors go through all the cards saved before the migration
+	ctx, cancel := context.WithTimeout(db.Context(), 30*time.Minute)
+	defer cancel()
+
+	cur, err := db.Cards.Collection().Find(ctx, bson.M{
+		"media": bson.M{
+			string(op.Exists): false,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var card Card
+		if err := cur.Decode(&card); err != nil {
+			return err
+		}
+
+		_, err := db.Cards.UpdateById(card.BasicModel.ID, UpdateDocument{
+			op.Set: bson.M{
+				"media": cardMedia(card),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	trashCur, err := db.Trash.Collection().Find(ctx, bson.M{
+		"card": bson.M{
+			string(op.Exists): true,
+		},
+		"card.media": bson.M{
+			string(op.Exists): false,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer trashCur.Close(ctx)
+
+	for trashCur.Next(ctx) {
+		var item TrashItem
+		if err := trashCur.Decode(&item); err != nil {
+			return err
+		}
+
+		_, err := db.Trash.UpdateById(item.ID, UpdateDocument{
+			op.Set: bson.M{
+				"card.media": cardMedia(*item.Card),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return trashCur.Err()
+}
@@ -1,6 +1,7 @@
 package mongo
 
 import (
+	"encoding/json"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -37,8 +38,28 @@ const (
 	BasicPlan UserPlan = "BASIC"
 )
 
+// StorageQuota returns the maximum number of bytes of media
+// that a user with the plan can store
+func (p UserPlan) StorageQuota() int64 {
+	switch p {
+	case VIPPlan:
+		return 5 * 1024 * 1024 * 1024
+	default:
+		return 100 * 1024 * 1024
+	}
+}
+
 type UserStatistics struct {
 	DailyRepetitions map[string]int `bson:"dailyRepetitions" json:"dailyRepetitions"`
+	// VacationDays are the days spent on vacation, which are not missed days
+	VacationDays []string `bson:"vacationDays,omitempty" json:"vacationDays,omitempty"`
+}
+
+// UserVacation is set while the user is on vacation, on return the cards
+// that came due are spread over SpreadDays days
+type UserVacation struct {
+	StartedAt  time.Time `bson:"startedAt" json:"startedAt"`
+	SpreadDays int       `bson:"spreadDays" json:"spreadDays"`
 }
 
 type UserAchievements struct {
@@ -56,32 +77,225 @@ type User struct {
 	EndOfDay     int              `bson:"endOfDay" json:"endOfDay"`
 	Statistics   UserStatistics   `bson:"statistics" json:"statistics"`
 	Achievements UserAchievements `bson:"achievements" json:"achievements"`
+	StorageUsage int64            `bson:"storageUsage" json:"storageUsage"`
+	Vacation     *UserVacation    `bson:"vacation,omitempty" json:"vacation"`
+}
+
+// DeckRole is the level of access that a user has on a deck, each
+// role grants all the permissions of the previous ones
+type DeckRole string
+
+const (
+	NoRole DeckRole = ""
+	// PublicRole is the role of any user on a published deck
+	PublicRole DeckRole = "public"
+	ViewerRole DeckRole = "viewer"
+	EditorRole DeckRole = "editor"
+	OwnerRole  DeckRole = "owner"
+)
+
+func (r DeckRole) level() int {
+	switch r {
+	case PublicRole:
+		return 1
+	case ViewerRole:
+		return 2
+	case EditorRole:
+		return 3
+	case OwnerRole:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Valid checks whether the role is one of the roles that can be granted to a collaborator
+func (r DeckRole) Valid() bool {
+	return r.level() >= ViewerRole.level()
+}
+
+// Includes checks whether the role grants all the permissions of the other role
+func (r DeckRole) Includes(other DeckRole) bool {
+	return r.level() >= other.level()
+}
+
+// Collaborator is a user with whom a deck has been shared
+type Collaborator struct {
+	User  primitive.ObjectID `bson:"user" json:"user"`
+	Email string             `bson:"email" json:"email"`
+	Role  DeckRole           `bson:"role" json:"role"`
 }
 
 type Deck struct {
+	BasicModel    `bson:",inline"`
+	Archived      bool                `bson:"archived" json:"archived"`
+	Name          string              `bson:"name" json:"name"`
+	Cards         []Card              `bson:"-" json:"cards"`
+	Owner         primitive.ObjectID  `bson:"owner" json:"-"`
+	Parent        *primitive.ObjectID `bson:"parent" json:"parent"`
+	Collaborators []Collaborator      `bson:"collaborators,omitempty" json:"collaborators"`
+	// Published decks are listed in the public catalog and
+	// can be studied by any user that subscribes to them
+	Published   bool       `bson:"published" json:"published"`
+	Description string     `bson:"description,omitempty" json:"description,omitempty"`
+	PublishedAt *time.Time `bson:"publishedAt,omitempty" json:"publishedAt,omitempty"`
+	Subscribers int        `bson:"subscribers" json:"subscribers"`
+	// Role is the role of the user that requested the deck
+	Role DeckRole `bson:"-" json:"role,omitempty"`
+}
+
+// Subscription links a user to a published deck that they study,
+// the cards are not copied so the subscribers always see the
+// latest version of the deck
+type Subscription struct {
 	BasicModel `bson:",inline"`
-	Archived   bool               `bson:"archived" json:"archived"`
-	Name       string             `bson:"name" json:"name"`
-	Cards      []Card             `bson:"cards" json:"cards"`
-	Owner      primitive.ObjectID `bson:"owner" json:"-"`
+	User       primitive.ObjectID `bson:"user" json:"-"`
+	Deck       primitive.ObjectID `bson:"deck" json:"deck"`
 }
 
+// Card is stored in the cards collection, the ID field is the
+// identifier used by the clients and is unique within the deck
 type Card struct {
-	ID                 string     `bson:"id" json:"id"`
-	Front              string     `bson:"front" json:"front"`
-	Back               string     `bson:"back" json:"back"`
-	Factor             float32    `bson:"factor" json:"factor"`
-	HalfLife           float32    `bson:"halfLife" json:"halfLife"`
-	TotalRepetitions   float32    `bson:"totalRepetitions" json:"totalRepetitions"`
-	CorrectRepetitions float32    `bson:"correctRepetitions" json:"correctRepetitions"`
-	LastRepetition     *time.Time `bson:"lastRepetition" json:"lastRepetition"`
-	Paused             bool       `bson:"paused" json:"paused"`
+	BasicModel         `bson:",inline" json:"-"`
+	ID                 string             `bson:"id" json:"id"`
+	DeckID             primitive.ObjectID `bson:"deckId" json:"deckId"`
+	Front              string             `bson:"front" json:"front"`
+	Back               string             `bson:"back" json:"back"`
+	Factor             float32            `bson:"factor" json:"factor"`
+	HalfLife           float32            `bson:"halfLife" json:"halfLife"`
+	TotalRepetitions   float32            `bson:"totalRepetitions" json:"totalRepetitions"`
+	CorrectRepetitions float32            `bson:"correctRepetitions" json:"correctRepetitions"`
+	LastRepetition     *time.Time         `bson:"lastRepetition" json:"lastRepetition"`
+	// DueAt overrides the due time computed from the last repetition and the
+	// half-life, it is set when the due cards are spread after a vacation
+	DueAt  *time.Time `bson:"dueAt,omitempty" json:"dueAt,omitempty"`
+	Paused bool       `bson:"paused" json:"paused"`
+	Tags   []string   `bson:"tags,omitempty" json:"tags"`
+	// Media contains the IDs of the blobs referenced by the front and the
+	// back, it is indexed to find the cards that use a blob
+	Media []string `bson:"media" json:"-"`
 }
 
+// MarshalJSON encodes the card, the tags of an untagged card are
+// returned as an empty list
+func (c Card) MarshalJSON() ([]byte, error) {
+	type card Card
+	if c.Tags == nil {
+		c.Tags = []string{}
+	}
+
+	return json.Marshal(card(c))
+}
+
+// Repetition is a review of a card, UserID is nil for the repetitions
+// of the deck's owner and is set for the ones of the collaborators.
+// ArchivedAt is set when the scheduling of the card is reset, the archived
+// repetitions are kept in the history but no longer affect the scheduling
 type Repetition struct {
 	BasicModel `bson:",inline"`
-	CardId     string             `bson:"cardId" json:"cardId"`
-	DeckID     primitive.ObjectID `bson:"deckId" json:"deckId"`
-	Date       time.Time          `bson:"date" json:"date"`
-	Quality    int                `bson:"quality" json:"quality"`
+	CardId     string              `bson:"cardId" json:"cardId"`
+	DeckID     primitive.ObjectID  `bson:"deckId" json:"deckId"`
+	UserID     *primitive.ObjectID `bson:"userId,omitempty" json:"-"`
+	Date       time.Time           `bson:"date" json:"date"`
+	Quality    int                 `bson:"quality" json:"quality"`
+	ArchivedAt *time.Time          `bson:"archivedAt,omitempty" json:"archivedAt,omitempty"`
+}
+
+// CardSchedule is the scheduling state of a card for a collaborator of its
+// deck, the scheduling state of the deck's owner is stored in the card
+type CardSchedule struct {
+	BasicModel         `bson:",inline" json:"-"`
+	UserID             primitive.ObjectID `bson:"userId" json:"-"`
+	DeckID             primitive.ObjectID `bson:"deckId" json:"deckId"`
+	CardId             string             `bson:"cardId" json:"cardId"`
+	Factor             float32            `bson:"factor" json:"factor"`
+	HalfLife           float32            `bson:"halfLife" json:"halfLife"`
+	TotalRepetitions   float32            `bson:"totalRepetitions" json:"totalRepetitions"`
+	CorrectRepetitions float32            `bson:"correctRepetitions" json:"correctRepetitions"`
+	LastRepetition     *time.Time         `bson:"lastRepetition" json:"lastRepetition"`
+	DueAt              *time.Time         `bson:"dueAt,omitempty" json:"dueAt,omitempty"`
+}
+
+// ShareLink grants anonymous read-only access to a deck to whoever
+// knows the token, only the SHA-256 hash of the token is stored
+type ShareLink struct {
+	BasicModel   `bson:",inline"`
+	TokenHash    string             `bson:"tokenHash" json:"-"`
+	Deck         primitive.ObjectID `bson:"deck" json:"deck"`
+	ExpiresAt    *time.Time         `bson:"expiresAt" json:"expiresAt"`
+	Views        int                `bson:"views" json:"views"`
+	LastViewedAt *time.Time         `bson:"lastViewedAt" json:"lastViewedAt"`
+}
+
+type DataExportStatus string
+
+const (
+	ExportPending DataExportStatus = "pending"
+	ExportReady   DataExportStatus = "ready"
+	ExportFailed  DataExportStatus = "failed"
+)
+
+// DataExport is an archive with all the data of a user, it is built in
+// the background and stored in the blob storage until it expires
+type DataExport struct {
+	BasicModel `bson:",inline"`
+	User       primitive.ObjectID `bson:"user" json:"-"`
+	Status     DataExportStatus   `bson:"status" json:"status"`
+	BlobID     string             `bson:"blobId,omitempty" json:"-"`
+	Size       int64              `bson:"size,omitempty" json:"size,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+}
+
+// DeckSnapshot is a copy of the cards of a deck and of the owner's scheduling
+// state at a point in time. The content is stored compressed, while the images
+// it uses are listed in Media so that they are not deleted while referenced
+type DeckSnapshot struct {
+	BasicModel  `bson:",inline"`
+	Deck        primitive.ObjectID `bson:"deck" json:"deck"`
+	Name        string             `bson:"name" json:"name"`
+	Cards       int                `bson:"cards" json:"cards"`
+	Repetitions int                `bson:"repetitions" json:"repetitions"`
+	Size        int                `bson:"size" json:"size"`
+	Media       []string           `bson:"media" json:"-"`
+	Content     []byte             `bson:"content" json:"-"`
+}
+
+// SnapshotContent is the content of a snapshot before compression
+type SnapshotContent struct {
+	Cards       []Card       `bson:"cards"`
+	Repetitions []Repetition `bson:"repetitions"`
+}
+
+type TrashItemType string
+
+const (
+	TrashedDeck TrashItemType = "deck"
+	TrashedCard TrashItemType = "card"
+)
+
+// TrashItem is a deck or a card deleted by a user, which can be restored until
+// it expires and is purged. The cards of a trashed deck and the repetitions of a
+// trashed card are left in their collections until the item is purged
+type TrashItem struct {
+	BasicModel `bson:",inline"`
+	Type       TrashItemType      `bson:"type" json:"type"`
+	Owner      primitive.ObjectID `bson:"owner" json:"-"`
+	DeletedBy  primitive.ObjectID `bson:"deletedBy" json:"-"`
+	// DeckID is the trashed deck or the deck of the trashed card
+	DeckID    primitive.ObjectID `bson:"deckId" json:"deckId"`
+	Name      string             `bson:"name" json:"name"`
+	CardCount int                `bson:"cardCount" json:"cardCount"`
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+	// Decks contains the trashed deck and its sub-decks deleted with it, while
+	// Reparented lists the sub-decks that were moved to the deck's parent
+	Decks      []Deck               `bson:"decks,omitempty" json:"-"`
+	Reparented []primitive.ObjectID `bson:"reparented,omitempty" json:"-"`
+	Card       *Card                `bson:"card,omitempty" json:"-"`
+}
+
+type Blob struct {
+	BasicModel `bson:",inline"`
+	Name       string             `bson:"name" json:"name"`
+	Owner      primitive.ObjectID `bson:"owner" json:"-"`
+	Size       int64              `bson:"size" json:"size"`
 }
@@ -0,0 +1,271 @@
+package mongo
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	op "github.com/ZaninAndrea/binder-server/internal/mongo/op"
+)
+
+// DeckSummary is a lightweight representation of a deck that
+// contains the card counts instead of the cards, the counts
+// include the cards of all the sub-decks and are computed with
+// the scheduling state of the user that requested the summary
+type DeckSummary struct {
+	ID          primitive.ObjectID  `bson:"_id" json:"id"`
+	CreatedAt   time.Time           `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time           `bson:"updatedAt" json:"updatedAt"`
+	Name        string              `bson:"name" json:"name"`
+	Archived    bool                `bson:"archived" json:"archived"`
+	Parent      *primitive.ObjectID `bson:"parent" json:"parent"`
+	TotalCards  int                 `bson:"totalCards" json:"totalCards"`
+	DueCards    int                 `bson:"dueCards" json:"dueCards"`
+	NewCards    int                 `bson:"newCards" json:"newCards"`
+	LastStudied *time.Time          `bson:"lastStudied" json:"lastStudied"`
+}
+
+// DeckSummaryQuery contains the options used to list the deck summaries
+type DeckSummaryQuery struct {
+	// User is the owner, a collaborator or a subscriber of the listed decks
+	User primitive.ObjectID
+	// Subscribed are the published decks the user subscribed to
+	Subscribed []primitive.ObjectID
+	// Archived filters the decks by their archived flag if it is not nil
+	Archived *bool
+	// SortBy is one of name, createdAt, updatedAt and lastStudied
+	SortBy     string
+	Descending bool
+	Limit      int
+	// Cursor is the value returned by the previous page, or an empty string
+	Cursor string
+}
+
+var ErrInvalidCursor error = fmt.Errorf("the pagination cursor is invalid")
+var ErrInvalidSortField error = fmt.Errorf("the sort field is invalid")
+
+var deckSummarySortFields = []string{"name", "createdAt", "updatedAt", "lastStudied"}
+
+// summaryCursor is the position of the last deck of a page
+type summaryCursor struct {
+	Value interface{}        `bson:"v"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+func encodeSummaryCursor(cursor summaryCursor) (string, error) {
+	raw, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeSummaryCursor(encoded string) (summaryCursor, error) {
+	var cursor summaryCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err := bson.Unmarshal(raw, &cursor); err != nil {
+		return cursor, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+// ListDeckSummaries returns a page of the summaries of the decks matching the
+// query and the cursor of the next page, which is empty on the last page.
+// A card is due when the time since its last repetition exceeds its half-life,
+// or when its due time has passed if it was set after a vacation
+func (db *Database) ListDeckSummaries(query DeckSummaryQuery, now time.Time) ([]*DeckSummary, string, error) {
+	sortValid := false
+	for _, field := range deckSummarySortFields {
+		sortValid = sortValid || field == query.SortBy
+	}
+	if !sortValid {
+		return nil, "", ErrInvalidSortField
+	}
+
+	subscribed := query.Subscribed
+	if subscribed == nil {
+		subscribed = []primitive.ObjectID{}
+	}
+	match := bson.M{
+		string(op.Or): bson.A{
+			bson.M{"owner": query.User},
+			bson.M{"collaborators.user": query.User},
+			bson.M{
+				"_id":       bson.M{string(op.In): subscribed},
+				"published": true,
+			},
+		},
+	}
+	if query.Archived != nil {
+		match["archived"] = *query.Archived
+	}
+
+	notPaused := bson.M{string(op.Ne): bson.A{"$paused", true}}
+	pipeline := bson.A{
+		bson.M{string(op.Match): match},
+		bson.M{string(op.GraphLookup): bson.M{
+			"from":             "decks",
+			"startWith":        "$_id",
+			"connectFromField": "_id",
+			"connectToField":   "parent",
+			"as":               "descendants",
+		}},
+		bson.M{string(op.Lookup): bson.M{
+			"from": "cards",
+			"let": bson.M{
+				"deckIds": bson.M{
+					string(op.ConcatArrays): bson.A{bson.A{"$_id"}, "$descendants._id"},
+				},
+				"shared": bson.M{string(op.Ne): bson.A{"$owner", query.User}},
+			},
+			"pipeline": bson.A{
+				bson.M{string(op.Match): bson.M{
+					string(op.Expr): bson.M{string(op.In): bson.A{"$deckId", "$$deckIds"}},
+				}},
+				// The collaborators use their own scheduling state
+				bson.M{string(op.Lookup): bson.M{
+					"from": "schedules",
+					"let":  bson.M{"deckId": "$deckId", "cardId": "$id"},
+					"pipeline": bson.A{
+						bson.M{string(op.Match): bson.M{
+							string(op.Expr): bson.M{string(op.And): bson.A{
+								bson.M{string(op.Eq): bson.A{"$userId", query.User}},
+								bson.M{string(op.Eq): bson.A{"$deckId", "$$deckId"}},
+								bson.M{string(op.Eq): bson.A{"$cardId", "$$cardId"}},
+							}},
+						}},
+					},
+					"as": "schedule",
+				}},
+				bson.M{string(op.AddFields): bson.M{
+					"lastRepetition": bson.M{string(op.Cond): bson.A{
+						"$$shared",
+						bson.M{string(op.First): "$schedule.lastRepetition"},
+						"$lastRepetition",
+					}},
+					"halfLife": bson.M{string(op.Cond): bson.A{
+						"$$shared",
+						bson.M{string(op.First): "$schedule.halfLife"},
+						"$halfLife",
+					}},
+					"dueAt": bson.M{string(op.Cond): bson.A{
+						"$$shared",
+						bson.M{string(op.First): "$schedule.dueAt"},
+						"$dueAt",
+					}},
+				}},
+				bson.M{string(op.Group): bson.M{
+					"_id":        nil,
+					"totalCards": bson.M{string(op.Sum): 1},
+					"newCards": bson.M{string(op.Sum): bson.M{string(op.Cond): bson.A{
+						bson.M{string(op.And): bson.A{
+							notPaused,
+							bson.M{string(op.Eq): bson.A{bson.M{string(op.IfNull): bson.A{"$lastRepetition", nil}}, nil}},
+						}},
+						1,
+						0,
+					}}},
+					"dueCards": bson.M{string(op.Sum): bson.M{string(op.Cond): bson.A{
+						bson.M{string(op.And): bson.A{
+							notPaused,
+							bson.M{string(op.Ne): bson.A{bson.M{string(op.IfNull): bson.A{"$lastRepetition", nil}}, nil}},
+							bson.M{string(op.Lte): bson.A{bson.M{string(op.IfNull): bson.A{
+								"$dueAt",
+								bson.M{string(op.Add): bson.A{"$lastRepetition", "$halfLife"}},
+							}}, now}},
+						}},
+						1,
+						0,
+					}}},
+					"lastStudied": bson.M{string(op.Max): "$lastRepetition"},
+				}},
+			},
+			"as": "statistics",
+		}},
+		bson.M{string(op.Project): bson.M{
+			"createdAt":   1,
+			"updatedAt":   1,
+			"name":        1,
+			"archived":    1,
+			"parent":      1,
+			"totalCards":  bson.M{string(op.IfNull): bson.A{bson.M{string(op.First): "$statistics.totalCards"}, 0}},
+			"newCards":    bson.M{string(op.IfNull): bson.A{bson.M{string(op.First): "$statistics.newCards"}, 0}},
+			"dueCards":    bson.M{string(op.IfNull): bson.A{bson.M{string(op.First): "$statistics.dueCards"}, 0}},
+			"lastStudied": bson.M{string(op.IfNull): bson.A{bson.M{string(op.First): "$statistics.lastStudied"}, nil}},
+		}},
+	}
+
+	// Skip the decks up to the cursor, the aggregation comparison operators
+	// are used since they order the values of different types (e.g. null)
+	comparison := op.Gt
+	direction := 1
+	if query.Descending {
+		comparison = op.Lt
+		direction = -1
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeSummaryCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		field := "$" + query.SortBy
+		pipeline = append(pipeline, bson.M{string(op.Match): bson.M{
+			string(op.Expr): bson.M{string(op.Or): bson.A{
+				bson.M{string(comparison): bson.A{field, cursor.Value}},
+				bson.M{string(op.And): bson.A{
+					bson.M{string(op.Eq): bson.A{field, cursor.Value}},
+					bson.M{string(comparison): bson.A{"$_id", cursor.ID}},
+				}},
+			}},
+		}})
+	}
+
+	// Load one more deck to know whether there is a next page
+	pipeline = append(pipeline,
+		bson.M{string(op.Sort): bson.D{
+			{Key: query.SortBy, Value: direction},
+			{Key: "_id", Value: direction},
+		}},
+		bson.M{string(op.Limit): query.Limit + 1},
+	)
+
+	summaries := []*DeckSummary{}
+	err := db.Decks.Aggregate(pipeline, &summaries)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(summaries) <= query.Limit {
+		return summaries, "", nil
+	}
+
+	summaries = summaries[:query.Limit]
+	last := summaries[len(summaries)-1]
+	var value interface{}
+	switch query.SortBy {
+	case "name":
+		value = last.Name
+	case "createdAt":
+		value = last.CreatedAt
+	case "updatedAt":
+		value = last.UpdatedAt
+	case "lastStudied":
+		value = last.LastStudied
+	}
+
+	nextCursor, err := encodeSummaryCursor(summaryCursor{Value: value, ID: last.ID})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return summaries, nextCursor, nil
+}
@@ -0,0 +1,398 @@
+// Package printable lays out flashcards as PDF documents meant to be printed,
+// either as double-sided sheets to cut or as a study list
+package printable
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// The core PDF fonts only support single-byte encodings, so a Unicode font is
+// embedded to print the cards in any alphabet. DejaVu is distributed under the
+// Bitstream Vera license, see https://dejavu-fonts.github.io/License.html
+var (
+	//go:embed fonts/DejaVuSansCondensed.ttf
+	regularFont []byte
+	//go:embed fonts/DejaVuSansCondensed-Bold.ttf
+	boldFont []byte
+)
+
+// fontFamily is the name of the embedded font in the documents
+const fontFamily = "DejaVu"
+
+// Image formats supported in the documents
+const (
+	PNG = "PNG"
+	JPG = "JPG"
+	GIF = "GIF"
+)
+
+type Image struct {
+	// Name identifies the image, the same image can be used in several cards
+	Name string
+	Type string
+	Data []byte
+}
+
+// Side is the content of a side of a card, the text lines are separated by newlines
+type Side struct {
+	Text   string
+	Images []Image
+}
+
+type Card struct {
+	Front Side
+	Back  Side
+}
+
+type Options struct {
+	Title string
+	// PageSize is "A4" or "Letter"
+	PageSize string
+	// Columns and Rows are the size of the grid of cards on each sheet
+	Columns int
+	Rows    int
+}
+
+// Limits of the grid
+const (
+	MaxColumns = 4
+	MaxRows    = 8
+)
+
+// Validate checks the options, setting the defaults for the missing ones
+func (o *Options) Validate() error {
+	switch strings.ToLower(o.PageSize) {
+	case "", "a4":
+		o.PageSize = "A4"
+	case "letter":
+		o.PageSize = "Letter"
+	default:
+		return fmt.Errorf("the page size must be A4 or Letter")
+	}
+
+	if o.Columns == 0 {
+		o.Columns = 2
+	}
+	if o.Rows == 0 {
+		o.Rows = 4
+	}
+	if o.Columns < 1 || o.Columns > MaxColumns {
+		return fmt.Errorf("the columns must be between 1 and %d", MaxColumns)
+	} else if o.Rows < 1 || o.Rows > MaxRows {
+		return fmt.Errorf("the rows must be between 1 and %d", MaxRows)
+	}
+
+	return nil
+}
+
+// Sizes in millimeters and points used by the layouts
+const (
+	pageMargin    = 10.0
+	cellPadding   = 4.0
+	lineHeight    = 0.45 // in millimeters per point of font size
+	maxFontSize   = 14.0
+	minFontSize   = 7.0
+	listFontSize  = 10.0
+	listImageSize = 35.0
+)
+
+// document wraps the PDF with the helpers shared by the layouts
+type document struct {
+	pdf *fpdf.Fpdf
+	// images maps the image names to whether they could be registered
+	images map[string]bool
+}
+
+func newDocument(options Options) *document {
+	pdf := fpdf.New("P", "mm", options.PageSize, "")
+	pdf.AddUTF8FontFromBytes(fontFamily, "", regularFont)
+	pdf.AddUTF8FontFromBytes(fontFamily, "B", boldFont)
+	pdf.SetMargins(pageMargin, pageMargin, pageMargin)
+	pdf.SetAutoPageBreak(false, pageMargin)
+	pdf.SetTitle(options.Title, true)
+	pdf.SetCreator("Binder", true)
+
+	return &document{
+		pdf:    pdf,
+		images: map[string]bool{},
+	}
+}
+
+// registerImage adds the image to the document, returning false if it cannot be decoded
+func (d *document) registerImage(image Image) bool {
+	if ok, registered := d.images[image.Name]; registered {
+		return ok
+	}
+
+	d.pdf.RegisterImageOptionsReader(image.Name, fpdf.ImageOptions{ImageType: image.Type}, bytes.NewReader(image.Data))
+	ok := d.pdf.Ok()
+	if !ok {
+		// A broken image is skipped instead of failing the whole document
+		d.pdf.ClearError()
+	}
+	d.images[image.Name] = ok
+	return ok
+}
+
+// usableImages returns the images of the side that can be drawn
+func (d *document) usableImages(side Side) []Image {
+	images := []Image{}
+	for _, image := range side.Images {
+		if d.registerImage(image) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// printableText replaces the characters outside the Basic Multilingual Plane, such
+// as the emojis, which are not supported by the fonts embedded by fpdf
+func printableText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0xFFFF {
+			return '\uFFFD'
+		}
+		return r
+	}, text)
+}
+
+// lines splits the text in the lines that fit the width with the current font,
+// breaking the words that are longer than a line
+func (d *document) lines(text string, width float64) []string {
+	width -= 2 * d.pdf.GetCellMargin()
+	lines := []string{}
+	for _, paragraph := range strings.Split(printableText(text), "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if d.pdf.GetStringWidth(candidate) <= width {
+				line = candidate
+				continue
+			}
+
+			if line != "" {
+				lines = append(lines, line)
+			}
+			line = ""
+			for _, r := range word {
+				if line != "" && d.pdf.GetStringWidth(line+string(r)) > width {
+					lines = append(lines, line)
+					line = ""
+				}
+				line += string(r)
+			}
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// drawImages draws the images side by side, centered in the box and scaled to fit it
+func (d *document) drawImages(images []Image, x, y, width, height float64) {
+	if len(images) == 0 || height <= 0 {
+		return
+	}
+
+	slotWidth := width / float64(len(images))
+	for i, image := range images {
+		info := d.pdf.GetImageInfo(image.Name)
+		if info == nil || info.Width() == 0 || info.Height() == 0 {
+			continue
+		}
+
+		scale := slotWidth / info.Width()
+		if info.Height()*scale > height {
+			scale = height / info.Height()
+		}
+		imageWidth, imageHeight := info.Width()*scale, info.Height()*scale
+
+		d.pdf.ImageOptions(
+			image.Name,
+			x+float64(i)*slotWidth+(slotWidth-imageWidth)/2,
+			y+(height-imageHeight)/2,
+			imageWidth, imageHeight,
+			false, fpdf.ImageOptions{}, 0, "",
+		)
+	}
+}
+
+// drawSide draws the side centered in the cell, shrinking the font until the text fits
+func (d *document) drawSide(side Side, x, y, width, height float64) {
+	x, y = x+cellPadding, y+cellPadding
+	width, height = width-2*cellPadding, height-2*cellPadding
+	images := d.usableImages(side)
+
+	// The images take at least half of the cell, or all of it if there is no text
+	fontSize := maxFontSize
+	var lines []string
+	for ; ; fontSize-- {
+		d.pdf.SetFont(fontFamily, "", fontSize)
+		lines = d.lines(side.Text, width)
+		textHeight := float64(len(lines)) * fontSize * lineHeight
+		if len(images) > 0 {
+			textHeight += height / 2
+		}
+		if textHeight <= height || fontSize <= minFontSize {
+			break
+		}
+	}
+
+	lineSize := fontSize * lineHeight
+	maxLines := int(height / lineSize)
+	if len(images) > 0 {
+		maxLines = int(height / 2 / lineSize)
+	}
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+	}
+	textHeight := float64(len(lines)) * lineSize
+
+	imagesHeight := 0.0
+	if len(images) > 0 {
+		imagesHeight = height - textHeight
+		if len(lines) > 0 {
+			imagesHeight -= cellPadding
+		}
+	}
+
+	top := y + (height-textHeight-imagesHeight)/2
+	if len(images) > 0 {
+		top = y
+	}
+	for i, line := range lines {
+		d.pdf.SetXY(x, top+float64(i)*lineSize)
+		d.pdf.CellFormat(width, lineSize, line, "", 0, "C", false, 0, "")
+	}
+	d.drawImages(images, x, y+height-imagesHeight, width, imagesHeight)
+}
+
+// WriteGrid writes the cards as sheets to be printed double-sided and cut: each page
+// of fronts is followed by the page of the corresponding backs, whose columns are
+// mirrored so that each back is printed behind its front when flipping on the long edge
+func WriteGrid(w io.Writer, cards []Card, options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	doc := newDocument(options)
+	pageWidth, pageHeight := doc.pdf.GetPageSize()
+	cellWidth := (pageWidth - 2*pageMargin) / float64(options.Columns)
+	cellHeight := (pageHeight - 2*pageMargin) / float64(options.Rows)
+	perPage := options.Columns * options.Rows
+
+	for start := 0; start < len(cards) || start == 0; start += perPage {
+		end := start + perPage
+		if end > len(cards) {
+			end = len(cards)
+		}
+		sheet := cards[start:end]
+
+		for _, back := range []bool{false, true} {
+			doc.pdf.AddPage()
+			doc.pdf.SetDrawColor(160, 160, 160)
+			doc.pdf.SetDashPattern([]float64{2, 2}, 0)
+			for i := 0; i < perPage; i++ {
+				row, column := i/options.Columns, i%options.Columns
+				if back {
+					column = options.Columns - 1 - column
+				}
+				x := pageMargin + float64(column)*cellWidth
+				y := pageMargin + float64(row)*cellHeight
+				doc.pdf.Rect(x, y, cellWidth, cellHeight, "D")
+
+				if i >= len(sheet) {
+					continue
+				}
+				if back {
+					doc.drawSide(sheet[i].Back, x, y, cellWidth, cellHeight)
+				} else {
+					doc.drawSide(sheet[i].Front, x, y, cellWidth, cellHeight)
+				}
+			}
+			doc.pdf.SetDashPattern([]float64{}, 0)
+		}
+	}
+
+	return doc.pdf.Output(w)
+}
+
+// WriteList writes the cards as a list with the front on the left and the back on the right
+func WriteList(w io.Writer, cards []Card, options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	doc := newDocument(options)
+	pageWidth, pageHeight := doc.pdf.GetPageSize()
+	contentWidth := pageWidth - 2*pageMargin
+	frontWidth := contentWidth * 0.4
+	backWidth := contentWidth - frontWidth
+	lineSize := listFontSize * lineHeight
+
+	doc.pdf.AddPage()
+	doc.pdf.SetFont(fontFamily, "B", 18)
+	doc.pdf.CellFormat(contentWidth, 10, printableText(options.Title), "", 1, "L", false, 0, "")
+	y := doc.pdf.GetY() + 4
+
+	// sideHeight returns the lines of the side and the height of the side with its images
+	sideHeight := func(side Side, style string, width float64) ([]string, []Image, float64) {
+		doc.pdf.SetFont(fontFamily, style, listFontSize)
+		lines := doc.lines(side.Text, width-cellPadding)
+		images := doc.usableImages(side)
+		height := float64(len(lines)) * lineSize
+		if len(images) > 0 {
+			height += listImageSize + cellPadding/2
+		}
+		return lines, images, height
+	}
+	drawSide := func(lines []string, images []Image, style string, x, y, width float64) {
+		doc.pdf.SetFont(fontFamily, style, listFontSize)
+		for i, line := range lines {
+			doc.pdf.SetXY(x, y+float64(i)*lineSize)
+			doc.pdf.CellFormat(width-cellPadding, lineSize, line, "", 0, "L", false, 0, "")
+		}
+		if len(images) > 0 {
+			imagesTop := y + float64(len(lines))*lineSize + cellPadding/2
+			imagesWidth := float64(len(images)) * listImageSize
+			if imagesWidth > width-cellPadding {
+				imagesWidth = width - cellPadding
+			}
+			doc.drawImages(images, x, imagesTop, imagesWidth, listImageSize)
+		}
+	}
+
+	doc.pdf.SetDrawColor(200, 200, 200)
+	for _, card := range cards {
+		frontLines, frontImages, frontHeight := sideHeight(card.Front, "B", frontWidth)
+		backLines, backImages, backHeight := sideHeight(card.Back, "", backWidth)
+		height := frontHeight
+		if backHeight > height {
+			height = backHeight
+		}
+		height += cellPadding
+
+		// The cards are not split across pages, unless they are taller than a page
+		if y+height > pageHeight-pageMargin && y > pageMargin {
+			doc.pdf.AddPage()
+			y = pageMargin
+		}
+
+		drawSide(frontLines, frontImages, "B", pageMargin, y, frontWidth)
+		drawSide(backLines, backImages, "", pageMargin+frontWidth, y, backWidth)
+		y += height
+		doc.pdf.Line(pageMargin, y-cellPadding/2, pageWidth-pageMargin, y-cellPadding/2)
+	}
+
+	return doc.pdf.Output(w)
+}
@@ -0,0 +1,552 @@
+package rest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/anki"
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// MaxAnkiPackageSize is the maximum size in bytes of an imported Anki package
+const MaxAnkiPackageSize = 200 * 1024 * 1024
+
+// MaxAnkiEntrySize is the maximum decompressed size in bytes of each file in an
+// imported Anki package, the collection is extracted to a temporary file
+const MaxAnkiEntrySize = MaxAnkiPackageSize
+
+// ankiQuality maps the answer buttons of Anki (again, hard, good
+// and easy) to the quality of the repetitions
+var ankiQuality = map[int]int{
+	1: 1,
+	2: 3,
+	3: 4,
+	4: 5,
+}
+
+// ankiEase maps the quality of a repetition to the Anki answer button
+func ankiEase(quality int) int {
+	switch {
+	case quality < 3:
+		return 1
+	case quality == 3:
+		return 2
+	case quality == 4:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// ApplyRepetitions sets the scheduling state of the card by replaying its repetitions
+func ApplyRepetitions(card *mongo.Card, repetitions []*mongo.Repetition) {
+	update := processRepetitions(repetitions)
+	if update["totalRepetitions"].(int) == 0 {
+		return
+	}
+
+	card.Factor = update["factor"].(float32)
+	card.HalfLife = update["halfLife"].(float32)
+	card.TotalRepetitions = float32(update["totalRepetitions"].(int))
+	card.CorrectRepetitions = float32(update["correctRepetitions"].(int))
+	lastRepetition := update["lastRepetition"].(time.Time)
+	card.LastRepetition = &lastRepetition
+}
+
+// ankiImport contains the documents created from an Anki package
+type ankiImport struct {
+	decks       []*mongo.Deck
+	parents     map[*mongo.Deck]*mongo.Deck
+	cards       map[*mongo.Deck][]*mongo.Card
+	repetitions map[*mongo.Card][]*mongo.Repetition
+	media       []string
+}
+
+// convertAnkiPackage maps the decks, notes, cards and review log of the package to
+// the corresponding documents, the images are uploaded to the storage
+func convertAnkiPackage(pkg *anki.Package, user mongo.User, storage storage.BlobStorage) (*ankiImport, error) {
+	result := &ankiImport{
+		parents:     map[*mongo.Deck]*mongo.Deck{},
+		cards:       map[*mongo.Deck][]*mongo.Card{},
+		repetitions: map[*mongo.Card][]*mongo.Repetition{},
+	}
+
+	ankiDecks, err := pkg.Decks()
+	if err != nil {
+		return nil, err
+	}
+	models, err := pkg.Models()
+	if err != nil {
+		return nil, err
+	}
+	notes, err := pkg.Notes()
+	if err != nil {
+		return nil, err
+	}
+	ankiCards, err := pkg.Cards()
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := pkg.Reviews()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the decks lazily, so that only the decks containing
+	// cards and their ancestors are imported
+	decksByPath := map[string]*mongo.Deck{}
+	var deckForPath func(path []string) *mongo.Deck
+	deckForPath = func(path []string) *mongo.Deck {
+		key := strings.Join(path, "::")
+		if deck, ok := decksByPath[key]; ok {
+			return deck
+		}
+
+		deck := &mongo.Deck{
+			Name:  path[len(path)-1],
+			Owner: user.ID,
+		}
+		if len(path) > 1 {
+			result.parents[deck] = deckForPath(path[:len(path)-1])
+		}
+		decksByPath[key] = deck
+		result.decks = append(result.decks, deck)
+		return deck
+	}
+	decksById := map[int64]anki.Deck{}
+	for _, ankiDeck := range ankiDecks {
+		decksById[ankiDeck.ID] = ankiDeck
+	}
+
+	// Map each Anki card to a card rendered from its note. The uploaded images
+	// are returned also on failure, so that the caller can release them
+	uploaded := map[string]string{}
+	defer func() {
+		for _, blobID := range uploaded {
+			result.media = append(result.media, blobID)
+		}
+	}()
+	cardsById := map[int64]*mongo.Card{}
+	for _, ankiCard := range ankiCards {
+		note, ok := notes[ankiCard.NoteID]
+		if !ok {
+			continue
+		}
+		model, ok := models[note.ModelID]
+		if !ok {
+			continue
+		}
+
+		front, back, err := model.Render(note, ankiCard.Ord)
+		if err != nil {
+			return result, err
+		}
+		front, err = ReplaceMediaFiles(front, pkg, storage, uploaded)
+		if err != nil {
+			return result, err
+		}
+		back, err = ReplaceMediaFiles(back, pkg, storage, uploaded)
+		if err != nil {
+			return result, err
+		}
+
+		ankiDeck, ok := decksById[ankiCard.DeckID]
+		if !ok {
+			ankiDeck = anki.Deck{Name: "Anki"}
+		}
+		deck := deckForPath(ankiDeck.Path())
+
+		card, err := NewCard(primitive.NilObjectID, front, back, storage)
+		if err != nil {
+			return result, err
+		}
+		card.Paused = ankiCard.Queue == anki.QueueSuspended
+		card.Tags = note.Tags
+
+		cardsById[ankiCard.ID] = card
+		result.cards[deck] = append(result.cards[deck], card)
+	}
+
+	// Replay the review log, skipping the manual rescheduling
+	for _, review := range reviews {
+		card, ok := cardsById[review.CardID]
+		quality, validEase := ankiQuality[review.Ease]
+		if !ok || !validEase || review.Type == anki.ReviewManual {
+			continue
+		}
+
+		result.repetitions[card] = append(result.repetitions[card], &mongo.Repetition{
+			CardId:  card.ID,
+			Date:    time.UnixMilli(review.ID),
+			Quality: quality,
+		})
+	}
+	for card, repetitions := range result.repetitions {
+		ApplyRepetitions(card, repetitions)
+	}
+
+	return result, nil
+}
+
+// ankiExport contains the content of an exported Anki package
+type ankiExport struct {
+	decks []anki.Deck
+	cards []anki.ExportCard
+	media []string
+}
+
+// buildAnkiExport maps the deck, its sub-decks and their cards to an Anki package,
+// the scheduling state and the repetitions exported are the ones of the user
+func buildAnkiExport(db *mongo.Database, deck mongo.Deck, userId primitive.ObjectID) (*ankiExport, error) {
+	descendantIds, err := DescendantDeckIds(db, deck.ID)
+	if err != nil {
+		return nil, err
+	}
+	descendants := []*mongo.Deck{}
+	if len(descendantIds) > 0 {
+		err = db.Decks.FindAll(bson.M{
+			"_id": bson.M{string(op.In): descendantIds},
+		}, &descendants)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The sub-decks are named with their path from the exported deck
+	decksById := map[primitive.ObjectID]*mongo.Deck{deck.ID: &deck}
+	for _, descendant := range descendants {
+		decksById[descendant.ID] = descendant
+	}
+	var deckPath func(deck *mongo.Deck) string
+	deckPath = func(current *mongo.Deck) string {
+		if current.ID == deck.ID || current.Parent == nil || decksById[*current.Parent] == nil {
+			return current.Name
+		}
+		return deckPath(decksById[*current.Parent]) + "::" + current.Name
+	}
+
+	result := &ankiExport{}
+	ankiDeckIds := map[primitive.ObjectID]int64{}
+	baseId := time.Now().UnixMilli()
+	deckIds := append([]primitive.ObjectID{deck.ID}, descendantIds...)
+	for i, deckId := range deckIds {
+		ankiDeckIds[deckId] = baseId + int64(i)
+		result.decks = append(result.decks, anki.Deck{
+			ID:   ankiDeckIds[deckId],
+			Name: deckPath(decksById[deckId]),
+		})
+	}
+
+	cards, err := LoadCards(db, deckIds)
+	if err != nil {
+		return nil, err
+	}
+	err = ApplyCardSchedules(db, deck, userId, cards)
+	if err != nil {
+		return nil, err
+	}
+
+	repetitions := []*mongo.Repetition{}
+	err = db.Repetitions.FindAll(bson.M{
+		"deckId": bson.M{string(op.In): deckIds},
+		"userId": SchedulingUser(deck, userId),
+	}, &repetitions)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(repetitions, func(a, b *mongo.Repetition) bool {
+		return a.Date.Before(b.Date)
+	})
+	reviews := map[string][]anki.ExportReview{}
+	for _, repetition := range repetitions {
+		reviews[repetition.CardId] = append(reviews[repetition.CardId], anki.ExportReview{
+			Date: repetition.Date,
+			Ease: ankiEase(repetition.Quality),
+		})
+	}
+
+	for _, card := range cards {
+		front, frontMedia, err := ExportMediaFiles(card.Front, "")
+		if err != nil {
+			return nil, err
+		}
+		back, backMedia, err := ExportMediaFiles(card.Back, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, blobID := range append(frontMedia, backMedia...) {
+			if slices.Contains(result.media, blobID) {
+				continue
+			}
+
+			allowed, err := CanDeckUseMedia(db, *decksById[card.DeckID], blobID)
+			if err != nil {
+				return nil, err
+			} else if allowed {
+				result.media = append(result.media, blobID)
+			}
+		}
+
+		// The half-life, in milliseconds, is used as the interval
+		result.cards = append(result.cards, anki.ExportCard{
+			DeckID:     ankiDeckIds[card.DeckID],
+			GUID:       card.ID,
+			Front:      front,
+			Back:       back,
+			Tags:       card.Tags,
+			Suspended:  card.Paused,
+			LastReview: card.LastRepetition,
+			Interval:   time.Duration(card.HalfLife) * time.Millisecond,
+			Factor:     card.Factor,
+			Reviews:    reviews[card.ID],
+			Lapses:     int(card.TotalRepetitions - card.CorrectRepetitions),
+		})
+	}
+
+	return result, nil
+}
+
+// exportFilename returns the name, without extension, of the file exporting
+// the deck, replacing the characters that are not allowed in filenames
+func exportFilename(deckName string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, deckName)
+	if strings.TrimSpace(name) == "" {
+		name = "deck"
+	}
+
+	return name
+}
+
+func setupAnkiRoutes(r *gin.Engine, db *mongo.Database, blobStorage storage.BlobStorage) {
+	r.GET("/decks/:deckId/export.apkg", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		exported, err := buildAnkiExport(db, deck, user.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			restLogger.Error(err)
+			return
+		}
+
+		// The images are referenced by their blob ID, which is used as filename
+		media := []anki.MediaFile{}
+		for _, blobID := range exported.media {
+			exists, err := blobStorage.Exists(blobID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the images")
+				restLogger.Error(err)
+				return
+			} else if !exists {
+				continue
+			}
+
+			blobID := blobID
+			media = append(media, anki.MediaFile{
+				Name: blobID,
+				Open: func() (io.ReadCloser, error) {
+					return blobStorage.Download(blobID, 0, 0)
+				},
+			})
+		}
+
+		// Write the package to a temporary file, so that failures can still be reported
+		tmp, err := os.CreateTemp("", "binder-apkg-*.zip")
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the package")
+			restLogger.Error(err)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		err = anki.WritePackage(tmp, exported.decks, exported.cards, media)
+		tmp.Close()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the package")
+			restLogger.Error(err)
+			return
+		}
+
+		c.FileAttachment(tmp.Name(), exportFilename(deck.Name)+".apkg")
+	})
+
+	r.POST("/import/anki", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		// Store the package in a temporary file, since zip needs random access
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxAnkiPackageSize)
+		file, _, err := c.Request.FormFile("file")
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.String(http.StatusRequestEntityTooLarge, "The package cannot be larger than %d bytes", MaxAnkiPackageSize)
+			return
+		} else if err != nil {
+			c.String(http.StatusBadRequest, "The request must contain the package in the `file` field")
+			return
+		}
+		defer file.Close()
+
+		tmp, err := os.CreateTemp("", "binder-apkg-*.zip")
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to store the package")
+			restLogger.Error(err)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, file)
+		tmp.Close()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to store the package")
+			restLogger.Error(err)
+			return
+		}
+
+		pkg, err := anki.Open(tmp.Name(), MaxAnkiEntrySize)
+		if errors.Is(err, anki.ErrEntryTooLarge) {
+			c.String(http.StatusBadRequest, "The files in the package cannot be larger than %d bytes", MaxAnkiEntrySize)
+			return
+		} else if errors.Is(err, anki.ErrInvalidPackage) || errors.Is(err, anki.ErrUnsupportedPackage) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to read the package")
+			restLogger.Error(err)
+			return
+		}
+		defer pkg.Close()
+
+		// Convert the package, uploading the images
+		userStorage := UserStorage(db, blobStorage, user)
+		converted, err := convertAnkiPackage(pkg, user, userStorage)
+		if err != nil {
+			if converted != nil {
+				ReleaseUnusedMedia(db, blobStorage, converted.media)
+			}
+
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				c.String(http.StatusForbidden, "The images exceed the storage quota of your plan")
+			} else if errors.Is(err, anki.ErrEntryTooLarge) {
+				c.String(http.StatusBadRequest, "The files in the package cannot be larger than %d bytes", MaxAnkiEntrySize)
+			} else if errors.Is(err, anki.ErrInvalidPackage) || errors.Is(err, anki.ErrInvalidTemplate) {
+				c.String(http.StatusBadRequest, err.Error())
+			} else {
+				c.String(http.StatusInternalServerError, "Failed to convert the package")
+				restLogger.Error(err)
+			}
+			return
+		}
+
+		// Insert the decks from the top-level ones, so that the parents' IDs are known
+		slices.SortStableFunc(converted.decks, func(a, b *mongo.Deck) bool {
+			return ankiDeckDepth(converted.parents, a) < ankiDeckDepth(converted.parents, b)
+		})
+		_, err = db.Transaction(
+			120*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				for _, deck := range converted.decks {
+					if parent, ok := converted.parents[deck]; ok {
+						deck.Parent = &parent.ID
+					}
+
+					deckId, err := db.Decks.InsertOne(deck)
+					if err != nil {
+						return nil, err
+					}
+					deck.ID = deckId
+
+					cards := converted.cards[deck]
+					if len(cards) == 0 {
+						continue
+					}
+
+					repetitions := []*mongo.Repetition{}
+					for _, card := range cards {
+						card.DeckID = deckId
+						for _, repetition := range converted.repetitions[card] {
+							repetition.DeckID = deckId
+							repetitions = append(repetitions, repetition)
+						}
+					}
+
+					err = db.Cards.InsertMany(cards)
+					if err != nil {
+						return nil, err
+					}
+
+					if len(repetitions) > 0 {
+						err = db.Repetitions.InsertMany(repetitions)
+						if err != nil {
+							return nil, err
+						}
+					}
+				}
+
+				return nil, nil
+			},
+		)
+		if err != nil {
+			ReleaseUnusedMedia(db, blobStorage, converted.media)
+			c.String(http.StatusInternalServerError, "Failed to save the imported decks")
+			restLogger.Error(err)
+			return
+		}
+
+		// Report the imported documents
+		type importedDeck struct {
+			ID    primitive.ObjectID `json:"id"`
+			Name  string             `json:"name"`
+			Cards int                `json:"cards"`
+		}
+		decks := make([]importedDeck, len(converted.decks))
+		for i, deck := range converted.decks {
+			decks[i] = importedDeck{
+				ID:    deck.ID,
+				Name:  deck.Name,
+				Cards: len(converted.cards[deck]),
+			}
+		}
+		repetitions := 0
+		for _, cardRepetitions := range converted.repetitions {
+			repetitions += len(cardRepetitions)
+		}
+
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"decks":       decks,
+			"repetitions": repetitions,
+			"media":       len(converted.media),
+		})
+	})
+}
+
+// ankiDeckDepth returns the number of ancestors of the imported deck
+func ankiDeckDepth(parents map[*mongo.Deck]*mongo.Deck, deck *mongo.Deck) int {
+	depth := 0
+	for parent, ok := parents[deck]; ok; parent, ok = parents[parent] {
+		depth++
+	}
+
+	return depth
+}
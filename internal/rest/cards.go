@@ -1,7 +1,7 @@
 package rest
 
 import (
-	"log"
+	"errors"
 	"math"
 	"net/http"
 	"time"
@@ -27,6 +27,15 @@ func errorProbability(previousRepetition time.Time, time time.Time, halfLife flo
 }
 
 func processRepetitions(repetitions []*mongo.Repetition) bson.M {
+	// The repetitions archived by a reset are not replayed
+	active := []*mongo.Repetition{}
+	for _, repetition := range repetitions {
+		if repetition == nil || repetition.ArchivedAt == nil {
+			active = append(active, repetition)
+		}
+	}
+	repetitions = active
+
 	slices.SortFunc(repetitions, func(a, b *mongo.Repetition) bool {
 		if a == nil {
 			return true
@@ -76,176 +85,439 @@ func processRepetitions(repetitions []*mongo.Repetition) bson.M {
 	}
 
 	update := bson.M{
-		"cards.$.factor":             factor,
-		"cards.$.halfLife":           halfLife,
-		"cards.$.totalRepetitions":   len(repetitions),
-		"cards.$.correctRepetitions": correctRepetitions,
+		"factor":             factor,
+		"halfLife":           halfLife,
+		"totalRepetitions":   len(repetitions),
+		"correctRepetitions": correctRepetitions,
+		// A new repetition replaces the due time set after a vacation
+		"dueAt": nil,
 	}
 	if len(repetitions) > 0 {
-		update["cards.$.lastRepetition"] = repetitions[len(repetitions)-1].Date
+		update["lastRepetition"] = repetitions[len(repetitions)-1].Date
 	}
 
 	return update
 }
 
-func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobStorage) {
-	r.POST("/decks/:deckId/cards", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Load user
-		exists, err, user := GetAuthenticatedUser(c, db)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
-			restLogger.Error(err)
-			return
-		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
-			return
+// MaxBulkCards is the maximum number of cards that can be created with a single request
+const MaxBulkCards = 1000
+
+// NewCard uploads the base64 images contained in the front and back
+// and returns a new card, with no repetitions, for the deck
+func NewCard(deckId primitive.ObjectID, front string, back string, storage storage.BlobStorage) (*mongo.Card, error) {
+	originalFront := front
+	front, err := ReplaceBase64ImagesWithFileLinks(front, storage)
+	if err != nil {
+		return nil, err
+	}
+	back, err = ReplaceBase64ImagesWithFileLinks(back, storage)
+	if err != nil {
+		// Release the images uploaded for the front, since the card is not created
+		uploaded, _ := Diff(originalFront, front)
+		for _, blobID := range uploaded {
+			_ = storage.Delete(blobID)
 		}
+		return nil, err
+	}
+
+	card := &mongo.Card{
+		ID:                 uuid.NewString(),
+		DeckID:             deckId,
+		Front:              front,
+		Back:               back,
+		Factor:             2.5,
+		LastRepetition:     nil,
+		HalfLife:           0,
+		TotalRepetitions:   0,
+		CorrectRepetitions: 0,
+		Paused:             false,
+	}
+	card.Media = CardMedia(*card)
+
+	return card, nil
+}
+
+// MoveCard moves the card, its repetitions and the scheduling state of
+// the collaborators to another deck, it should be called inside a transaction
+func MoveCard(db *mongo.Database, card mongo.Card, newDeckId primitive.ObjectID) (mongo.Card, error) {
+	_, err := MoveCards(db, card.DeckID, []string{card.ID}, newDeckId)
+	if err != nil {
+		return card, err
+	}
+
+	card.DeckID = newDeckId
+	return card, nil
+}
+
+// MoveCards moves the cards of the deck with the specified IDs, or all of them if
+// cardIds is nil, to another deck together with their repetitions and the scheduling
+// state of the collaborators. The two decks must have the same owner, whose state
+// is stored in the cards. It returns the number of cards moved and should be
+// called inside a transaction
+func MoveCards(db *mongo.Database, deckId primitive.ObjectID, cardIds []string, newDeckId primitive.ObjectID) (int64, error) {
+	cardFilter := bson.M{"deckId": deckId}
+	historyFilter := bson.M{"deckId": deckId}
+	if cardIds != nil {
+		cardFilter["id"] = bson.M{string(op.In): cardIds}
+		historyFilter["cardId"] = bson.M{string(op.In): cardIds}
+	}
+
+	res, err := db.Cards.UpdateMany(cardFilter, mongo.UpdateDocument{
+		op.Set: bson.M{
+			"deckId": newDeckId,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
 
-		// Load deck
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
+	_, err = db.Repetitions.UpdateMany(historyFilter, mongo.UpdateDocument{
+		op.Set: bson.M{
+			"deckId": newDeckId,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Schedules.UpdateMany(historyFilter, mongo.UpdateDocument{
+		op.Set: bson.M{
+			"deckId": newDeckId,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+// CopyCard inserts a copy of the card and of the repetitions of the scheduling
+// user in another deck, the card must already hold the scheduling state of that
+// user (see ApplyCardSchedules). It should be called inside a transaction
+func CopyCard(db *mongo.Database, card mongo.Card, schedulingUser *primitive.ObjectID, newDeckId primitive.ObjectID) (mongo.Card, error) {
+	oldDeckId := card.DeckID
+	oldCardId := card.ID
+	card.ID = uuid.NewString()
+	card.DeckID = newDeckId
+
+	// Copy card
+	_, err := db.Cards.InsertOne(&card)
+	if err != nil {
+		return card, err
+	}
+
+	// Copy repetitions
+	repetitions := []*mongo.Repetition{}
+	err = db.Repetitions.FindAll(bson.M{
+		"deckId": oldDeckId,
+		"cardId": oldCardId,
+		"userId": schedulingUser,
+	}, &repetitions)
+	if err != nil {
+		return card, err
+	}
+
+	if len(repetitions) > 0 {
+		for _, repetition := range repetitions {
+			repetition.DeckID = newDeckId
+			repetition.CardId = card.ID
+			repetition.UserID = nil
+		}
+
+		err = db.Repetitions.InsertMany(repetitions)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
-			return
+			return card, err
 		}
+	}
+
+	return card, nil
+}
+
+// DeleteCard deletes the card, its repetitions and the scheduling
+// state of the collaborators, it should be called inside a transaction
+func DeleteCard(db *mongo.Database, card mongo.Card) error {
+	_, err := db.Cards.DeleteById(card.BasicModel.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Repetitions.DeleteMany(bson.M{
+		"deckId": card.DeckID,
+		"cardId": card.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Schedules.DeleteMany(bson.M{
+		"deckId": card.DeckID,
+		"cardId": card.ID,
+	})
+	return err
+}
 
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+// ResetCardScheduling archives the repetitions of the card made by the
+// scheduling user (see SchedulingUser) and restores the scheduling state
+// of a new card, it should be called inside a transaction
+func ResetCardScheduling(db *mongo.Database, card mongo.Card, schedulingUser *primitive.ObjectID) error {
+	_, err := ResetCardsScheduling(db, card.DeckID, []string{card.ID}, schedulingUser)
+	return err
+}
+
+// ResetCardsScheduling archives the repetitions made by the scheduling user on the
+// cards of the deck with the specified IDs, or on all of them if cardIds is nil, and
+// restores the scheduling state of new cards. The archived repetitions are kept in
+// the history but are not replayed by processRepetitions. It returns the number of
+// cards reset and should be called inside a transaction
+func ResetCardsScheduling(db *mongo.Database, deckId primitive.ObjectID, cardIds []string, schedulingUser *primitive.ObjectID) (int64, error) {
+	cardFilter := bson.M{"deckId": deckId}
+	historyFilter := bson.M{"deckId": deckId}
+	if cardIds != nil {
+		cardFilter["id"] = bson.M{string(op.In): cardIds}
+		historyFilter["cardId"] = bson.M{string(op.In): cardIds}
+	}
+
+	repetitionsFilter := bson.M{
+		"userId":     schedulingUser,
+		"archivedAt": nil,
+	}
+	for key, value := range historyFilter {
+		repetitionsFilter[key] = value
+	}
+	_, err := db.Repetitions.UpdateMany(repetitionsFilter, mongo.UpdateDocument{
+		op.Set: bson.M{
+			"archivedAt": time.Now(),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The scheduling state of the collaborators is stored separately
+	if schedulingUser != nil {
+		historyFilter["userId"] = *schedulingUser
+		_, err = db.Schedules.DeleteMany(historyFilter)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
-			restLogger.Error(err)
-			return
-		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
-			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
-			return
+			return 0, err
 		}
 
+		return db.Cards.Count(cardFilter)
+	}
+
+	res, err := db.Cards.UpdateMany(cardFilter, mongo.UpdateDocument{
+		op.Set: bson.M{
+			"factor":             2.5,
+			"halfLife":           0,
+			"totalRepetitions":   0,
+			"correctRepetitions": 0,
+			"lastRepetition":     nil,
+			"dueAt":              nil,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.MatchedCount, nil
+}
+
+func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage storage.BlobStorage) {
+	r.POST("/decks/:deckId/cards", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
 		// Parse card
 		var payload struct {
 			Front string `json:"front"`
 			Back  string `json:"back"`
 		}
-		err = c.ShouldBindJSON(&payload)
+		err := c.ShouldBindJSON(&payload)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Invalid payload")
 			return
 		}
-		cardId := uuid.NewString()
-		front, err := ReplaceBase64ImagesWithFileLinks(payload.Front, storage)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to replace base64 images with file links")
-			restLogger.Error(err)
+		newCard, err := NewCard(deck.ID, payload.Front, payload.Back, UserStorage(db, storage, user))
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			c.String(http.StatusForbidden, "The images exceed the storage quota of your plan")
 			return
-		}
-		back, err := ReplaceBase64ImagesWithFileLinks(payload.Back, storage)
-		if err != nil {
+		} else if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to replace base64 images with file links")
 			restLogger.Error(err)
 			return
 		}
-		newCard := mongo.Card{
-			ID:                 cardId,
-			Front:              front,
-			Back:               back,
-			Factor:             2.5,
-			LastRepetition:     nil,
-			HalfLife:           0,
-			TotalRepetitions:   0,
-			CorrectRepetitions: 0,
-			Paused:             false,
-		}
 
 		// Add card
-		_, err = db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
-			op.Push: bson.M{
-				"cards": newCard,
-			},
-		})
+		_, err = db.Cards.InsertOne(newCard)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to save card")
 			restLogger.Error(err)
 			return
 		}
 
-		c.String(http.StatusOK, cardId)
+		c.String(http.StatusOK, newCard.ID)
 	})
 
-	r.PUT("/decks/:deckId/cards/:cardId", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Load user
-		exists, err, user := GetAuthenticatedUser(c, db)
+	r.POST("/decks/:deckId/cards/bulk", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// Parse cards
+		var payload struct {
+			Cards []struct {
+				Front  string `json:"front"`
+				Back   string `json:"back"`
+				Paused bool   `json:"paused"`
+			} `json:"cards"`
+		}
+		err := c.ShouldBindJSON(&payload)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
-			restLogger.Error(err)
+			c.String(http.StatusBadRequest, "Invalid payload")
 			return
-		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+		} else if len(payload.Cards) == 0 {
+			c.String(http.StatusBadRequest, "You must specify at least one card")
+			return
+		} else if len(payload.Cards) > MaxBulkCards {
+			c.String(http.StatusBadRequest, "You can create at most %d cards at once", MaxBulkCards)
 			return
 		}
 
-		// Load deck
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
-		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
-			return
+		// Prepare the cards, the invalid ones are reported and skipped
+		type bulkResult struct {
+			ID    string `json:"id,omitempty"`
+			Error string `json:"error,omitempty"`
 		}
+		results := make([]bulkResult, len(payload.Cards))
+		newCards := []*mongo.Card{}
+		userStorage := UserStorage(db, storage, user)
+		for i, item := range payload.Cards {
+			if item.Front == "" && item.Back == "" {
+				results[i].Error = "The card is empty"
+				continue
+			}
 
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
-			restLogger.Error(err)
-			return
-		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
-			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
-			return
+			newCard, err := NewCard(deck.ID, item.Front, item.Back, userStorage)
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				results[i].Error = "The images exceed the storage quota of your plan"
+				continue
+			} else if err != nil {
+				results[i].Error = "Failed to replace base64 images with file links"
+				restLogger.Error(err)
+				continue
+			}
+			newCard.Paused = item.Paused
+
+			results[i].ID = newCard.ID
+			newCards = append(newCards, newCard)
+		}
+
+		// Add cards
+		if len(newCards) > 0 {
+			err = db.Cards.InsertMany(newCards)
+			if err != nil {
+				media := []string{}
+				for _, card := range newCards {
+					media = append(media, CardMedia(*card)...)
+				}
+				ReleaseUnusedMedia(db, storage, media)
+
+				c.String(http.StatusInternalServerError, "Failed to save cards")
+				restLogger.Error(err)
+				return
+			}
 		}
 
+		c.JSON(http.StatusOK, results)
+	})
+
+	r.PUT("/decks/:deckId/cards/:cardId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
 		// Parse update
 		var payload struct {
-			Front  *string `json:"front"`
-			Back   *string `json:"back"`
-			Paused *bool   `json:"paused"`
+			Front  *string   `json:"front"`
+			Back   *string   `json:"back"`
+			Paused *bool     `json:"paused"`
+			Tags   *[]string `json:"tags"`
 		}
-		err = c.ShouldBindJSON(&payload)
+		err := c.ShouldBindJSON(&payload)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Invalid payload")
 			return
 		}
+		cardId := c.Param("cardId")
+
+		// Load card
+		var card mongo.Card
+		exists, err := db.Cards.FindOneIfExists(bson.M{
+			"deckId": deck.ID,
+			"id":     cardId,
+		}, &card)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the card")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusBadRequest, "The specified card does not exist")
+			return
+		}
+
 		update := bson.M{}
+		updated := card
+		removedMedia := []string{}
+		userStorage := UserStorage(db, storage, user)
 		if payload.Front != nil {
-			front, err := ReplaceBase64ImagesWithFileLinks(*payload.Front, storage)
-			if err != nil {
+			front, err := ReplaceBase64ImagesWithFileLinks(*payload.Front, userStorage)
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				c.String(http.StatusForbidden, "The images exceed the storage quota of your plan")
+				return
+			} else if err != nil {
 				c.String(http.StatusInternalServerError, "Failed to replace base64 images with file links")
 				restLogger.Error(err)
 				return
 			}
-			update["cards.$.front"] = front
+			update["front"] = front
+			updated.Front = front
+
+			_, removed := Diff(card.Front, front)
+			removedMedia = append(removedMedia, removed...)
 		}
 		if payload.Back != nil {
-			back, err := ReplaceBase64ImagesWithFileLinks(*payload.Back, storage)
-			if err != nil {
+			back, err := ReplaceBase64ImagesWithFileLinks(*payload.Back, userStorage)
+			if err != nil && payload.Front != nil {
+				// Release the images uploaded for the front, since the card is not updated
+				uploaded, _ := Diff(*payload.Front, updated.Front)
+				for _, blobID := range uploaded {
+					_ = userStorage.Delete(blobID)
+				}
+			}
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				c.String(http.StatusForbidden, "The images exceed the storage quota of your plan")
+				return
+			} else if err != nil {
 				c.String(http.StatusInternalServerError, "Failed to replace base64 images with file links")
 				restLogger.Error(err)
 				return
 			}
-			update["cards.$.back"] = back
+			update["back"] = back
+			updated.Back = back
+
+			_, removed := Diff(card.Back, back)
+			removedMedia = append(removedMedia, removed...)
+		}
+		if payload.Front != nil || payload.Back != nil {
+			update["media"] = CardMedia(updated)
 		}
 		if payload.Paused != nil {
-			update["cards.$.paused"] = payload.Paused
+			update["paused"] = payload.Paused
+		}
+		if payload.Tags != nil {
+			update["tags"] = *payload.Tags
 		}
 
 		// Apply update
-		_, err = db.Decks.UpdateOne(bson.M{
-			"_id":      deck.ID,
-			"cards.id": c.Param("cardId"),
-		}, mongo.UpdateDocument{
+		_, err = db.Cards.UpdateById(card.BasicModel.ID, mongo.UpdateDocument{
 			op.Set: update,
 		})
 		if err != nil {
@@ -254,67 +526,36 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 			return
 		}
 
+		ReleaseUnusedMedia(db, storage, removedMedia)
+
 		c.String(http.StatusOK, "")
 	})
 
-	r.DELETE("/decks/:deckId/cards/:cardId", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Load user
-		exists, err, user := GetAuthenticatedUser(c, db)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
-			restLogger.Error(err)
-			return
-		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
-			return
-		}
+	r.DELETE("/decks/:deckId/cards/:cardId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
 
-		// Load deck
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
-		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
-			return
-		}
-
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		cardId := c.Param("cardId")
+		// Load card
+		var card mongo.Card
+		exists, err := db.Cards.FindOneIfExists(bson.M{
+			"deckId": deck.ID,
+			"id":     cardId,
+		}, &card)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			c.String(http.StatusInternalServerError, "Failed to load the card")
 			restLogger.Error(err)
 			return
 		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
-			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
+			c.String(http.StatusBadRequest, "The specified card does not exist")
 			return
 		}
 
-		// Apply update
-		_, err = db.Transaction(
+		// Move the card to the trash, the images are released when it is purged
+		item, err := db.Transaction(
 			30*time.Second,
 			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
-				_, err := db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
-					op.Pull: bson.M{
-						"cards": bson.M{
-							"id": c.Param("cardId"),
-						},
-					},
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				_, err = db.Repetitions.DeleteMany(bson.M{
-					"deckId": deck.ID,
-					"cardId": c.Param("cardId"),
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				return nil, nil
+				return TrashCard(db, deck, card, user.ID)
 			},
 		)
 		if err != nil {
@@ -323,48 +564,99 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 			return
 		}
 
-		c.String(http.StatusOK, "")
+		// The ID of the trash item allows undoing the deletion
+		c.String(http.StatusOK, item.(*mongo.TrashItem).ID.Hex())
 	})
 
-	r.PUT("/decks/:deckId/cards/:cardId/move", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Load user
-		exists, err, user := GetAuthenticatedUser(c, db)
+	r.PUT("/decks/:deckId/cards/:cardId/move", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// Load target deck
+		var payload struct {
+			NewDeckId string `json:"newDeckId"`
+		}
+		err := c.ShouldBindJSON(&payload)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
+			c.String(http.StatusBadRequest, "Invalid payload")
+			return
+		}
+
+		newDeckId, err := primitive.ObjectIDFromHex(payload.NewDeckId)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid new deck id")
+			return
+		}
+
+		var newDeck mongo.Deck
+		exists, err := db.Decks.FindByIdIfExists(newDeckId, &newDeck)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the new deck")
 			restLogger.Error(err)
 			return
 		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			c.String(http.StatusBadRequest, "The specified new deck does not exist")
 			return
 		}
 
-		// Load deck
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
+		newDeckRole, err := DeckRoleOf(db, newDeck, user.ID)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
+			c.String(http.StatusInternalServerError, "Failed to load the new deck")
+			restLogger.Error(err)
+			return
+		} else if !newDeckRole.Includes(mongo.EditorRole) {
+			c.String(http.StatusUnauthorized, "You need the %s role on the new deck", mongo.EditorRole)
 			return
 		}
 
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		cardId := c.Param("cardId")
+		// Load card
+		var card mongo.Card
+		exists, err = db.Cards.FindOneIfExists(bson.M{
+			"deckId": deck.ID,
+			"id":     cardId,
+		}, &card)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			c.String(http.StatusInternalServerError, "Failed to load the card")
 			restLogger.Error(err)
 			return
 		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
+			c.String(http.StatusBadRequest, "The specified card does not exist")
 			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
+		}
+
+		// The owner's scheduling state and repetitions would otherwise be
+		// attributed to the owner of the new deck
+		if newDeck.Owner != deck.Owner {
+			c.String(http.StatusForbidden, "You can only move cards between decks with the same owner")
 			return
 		}
 
+		// Apply update
+		newCard, err := db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				return MoveCard(db, card, newDeck.ID)
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to copy card")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, newCard)
+	})
+
+	r.PUT("/decks/:deckId/cards/:cardId/copy", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
 		// Load target deck
 		var payload struct {
 			NewDeckId string `json:"newDeckId"`
 		}
-		err = c.ShouldBindJSON(&payload)
+		err := c.ShouldBindJSON(&payload)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Invalid payload")
 			return
@@ -377,7 +669,7 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 		}
 
 		var newDeck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(newDeckId, &newDeck)
+		exists, err := db.Decks.FindByIdIfExists(newDeckId, &newDeck)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to load the new deck")
 			restLogger.Error(err)
@@ -385,57 +677,48 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 		} else if !exists {
 			c.String(http.StatusBadRequest, "The specified new deck does not exist")
 			return
-		} else if newDeck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of the new deck")
+		}
+
+		newDeckRole, err := DeckRoleOf(db, newDeck, user.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the new deck")
+			restLogger.Error(err)
+			return
+		} else if !newDeckRole.Includes(mongo.EditorRole) {
+			c.String(http.StatusUnauthorized, "You need the %s role on the new deck", mongo.EditorRole)
 			return
 		}
 
 		cardId := c.Param("cardId")
+		// Load card
+		var card mongo.Card
+		exists, err = db.Cards.FindOneIfExists(bson.M{
+			"deckId": deck.ID,
+			"id":     cardId,
+		}, &card)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the card")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusBadRequest, "The specified card does not exist")
+			return
+		}
+
+		// The scheduling state copied is the one of the requesting user
+		cards := []mongo.Card{card}
+		err = ApplyCardSchedules(db, deck, user.ID, cards)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the scheduling state")
+			restLogger.Error(err)
+			return
+		}
+
 		// Apply update
 		newCard, err := db.Transaction(
 			30*time.Second,
 			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
-				_, err := db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
-					op.Pull: bson.M{
-						"cards": bson.M{
-							"id": cardId,
-						},
-					},
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				var card mongo.Card
-				for _, c := range deck.Cards {
-					if c.ID == cardId {
-						card = c
-						break
-					}
-				}
-
-				_, err = db.Decks.UpdateById(newDeck.ID, mongo.UpdateDocument{
-					op.Push: bson.M{
-						"cards": card,
-					},
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				_, err = db.Repetitions.UpdateMany(bson.M{
-					"deckId": deck.ID,
-					"cardId": cardId,
-				}, mongo.UpdateDocument{
-					op.Set: bson.M{
-						"deckId": newDeck.ID,
-					},
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				return card, nil
+				return CopyCard(db, cards[0], SchedulingUser(deck, user.ID), newDeck.ID)
 			},
 		)
 		if err != nil {
@@ -447,190 +730,378 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 		c.JSON(http.StatusOK, newCard)
 	})
 
-	r.PUT("/decks/:deckId/cards/:cardId/copy", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Load user
-		exists, err, user := GetAuthenticatedUser(c, db)
+	// Resetting the scheduling of a card makes the requesting user relearn it from
+	// scratch, the previous repetitions are archived instead of being deleted
+	r.POST("/decks/:deckId/cards/:cardId/reset", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), StudyAuthorized(db), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		cardId := c.Param("cardId")
+		// Load card
+		var card mongo.Card
+		exists, err := db.Cards.FindOneIfExists(bson.M{
+			"deckId": deck.ID,
+			"id":     cardId,
+		}, &card)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
+			c.String(http.StatusInternalServerError, "Failed to load the card")
 			restLogger.Error(err)
 			return
 		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			c.String(http.StatusBadRequest, "The specified card does not exist")
+			return
+		}
+
+		_, err = db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				return nil, ResetCardScheduling(db, card, SchedulingUser(deck, user.ID))
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to reset the card")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	// Resetting a deck resets also the cards of its sub-decks
+	r.POST("/decks/:deckId/reset", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), StudyAuthorized(db), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		descendantIds, err := DescendantDeckIds(db, deck.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the sub-decks")
+			restLogger.Error(err)
 			return
 		}
+		deckIds := append([]primitive.ObjectID{deck.ID}, descendantIds...)
+
+		reset, err := db.Transaction(
+			60*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				total := int64(0)
+				for _, deckId := range deckIds {
+					reset, err := ResetCardsScheduling(db, deckId, nil, SchedulingUser(deck, user.ID))
+					if err != nil {
+						return nil, err
+					}
+					total += reset
+				}
 
-		// Load deck
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
+				return total, nil
+			},
+		)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
+			c.String(http.StatusInternalServerError, "Failed to reset the cards")
+			restLogger.Error(err)
 			return
 		}
 
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		c.JSON(http.StatusOK, map[string]int64{
+			"cards": reset.(int64),
+		})
+	})
+
+	r.POST("/cards/bulk-actions", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			c.String(http.StatusInternalServerError, "Failed to load the user")
 			restLogger.Error(err)
 			return
 		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
-			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
 			return
 		}
 
-		// Load target deck
+		// Parse payload
 		var payload struct {
+			Cards []struct {
+				DeckId string `json:"deckId"`
+				CardId string `json:"cardId"`
+			} `json:"cards"`
+			Action    string `json:"action"`
 			NewDeckId string `json:"newDeckId"`
+			Tag       string `json:"tag"`
 		}
 		err = c.ShouldBindJSON(&payload)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Invalid payload")
 			return
+		} else if len(payload.Cards) == 0 {
+			c.String(http.StatusBadRequest, "You must specify at least one card")
+			return
+		} else if len(payload.Cards) > MaxBulkCards {
+			c.String(http.StatusBadRequest, "You can update at most %d cards at once", MaxBulkCards)
+			return
 		}
 
-		newDeckId, err := primitive.ObjectIDFromHex(payload.NewDeckId)
-		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid new deck id")
+		var newDeckId primitive.ObjectID
+		var newDeck mongo.Deck
+		switch payload.Action {
+		case "pause", "unpause", "delete", "reset":
+		case "addTag", "removeTag":
+			if payload.Tag == "" {
+				c.String(http.StatusBadRequest, "You must specify a non-empty `tag` field")
+				return
+			}
+		case "move", "copy":
+			newDeckId, err = primitive.ObjectIDFromHex(payload.NewDeckId)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid new deck id")
+				return
+			}
+
+			exists, err = db.Decks.FindByIdIfExists(newDeckId, &newDeck)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the new deck")
+				restLogger.Error(err)
+				return
+			} else if !exists {
+				c.String(http.StatusBadRequest, "The specified new deck does not exist")
+				return
+			}
+
+			newDeckRole, err := DeckRoleOf(db, newDeck, user.ID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the new deck")
+				restLogger.Error(err)
+				return
+			} else if !newDeckRole.Includes(mongo.EditorRole) {
+				c.String(http.StatusUnauthorized, "You need the %s role on the new deck", mongo.EditorRole)
+				return
+			}
+		default:
+			c.String(http.StatusBadRequest, "Unknown action %q", payload.Action)
 			return
 		}
 
-		var newDeck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(newDeckId, &newDeck)
+		// Check that the user has the required role on all the decks of the selected cards
+		cardIdsByDeck := map[primitive.ObjectID][]string{}
+		selectedCards := 0
+		for _, item := range payload.Cards {
+			deckId, err := primitive.ObjectIDFromHex(item.DeckId)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid deck id")
+				return
+			}
+
+			if !slices.Contains(cardIdsByDeck[deckId], item.CardId) {
+				cardIdsByDeck[deckId] = append(cardIdsByDeck[deckId], item.CardId)
+				selectedCards++
+			}
+		}
+
+		deckIds := make([]primitive.ObjectID, 0, len(cardIdsByDeck))
+		for deckId := range cardIdsByDeck {
+			deckIds = append(deckIds, deckId)
+		}
+		decks := []*mongo.Deck{}
+		err = db.Decks.FindAll(bson.M{
+			"_id": bson.M{string(op.In): deckIds},
+		}, &decks)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the new deck")
+			c.String(http.StatusInternalServerError, "Failed to load the decks")
 			restLogger.Error(err)
 			return
-		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified new deck does not exist")
-			return
-		} else if newDeck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of the new deck")
+		} else if len(decks) != len(deckIds) {
+			c.String(http.StatusBadRequest, "Some of the specified decks do not exist")
 			return
 		}
 
-		cardId := c.Param("cardId")
-		// Apply update
-		card, err := db.Transaction(
-			30*time.Second,
-			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
-				var card mongo.Card
-				for _, c := range deck.Cards {
-					if c.ID == cardId {
-						card = c
-						break
-					}
-				}
-
-				card.ID = uuid.NewString()
+		// Studying and copying only require access to the cards
+		requiredRole := mongo.EditorRole
+		if payload.Action == "reset" || payload.Action == "copy" {
+			requiredRole = mongo.PublicRole
+		}
+		schedulingUsers := map[primitive.ObjectID]*primitive.ObjectID{}
+		decksById := map[primitive.ObjectID]*mongo.Deck{}
+		for _, deck := range decks {
+			role, err := DeckRoleOf(db, *deck, user.ID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the decks")
+				restLogger.Error(err)
+				return
+			} else if !role.Includes(requiredRole) {
+				c.String(http.StatusUnauthorized, "You need the %s role on all the specified decks", requiredRole)
+				return
+			}
 
-				// Copy card
-				_, err = db.Decks.UpdateById(newDeck.ID, mongo.UpdateDocument{
-					op.Push: bson.M{
-						"cards": card,
-					},
-				})
+			if payload.Action == "reset" {
+				allowed, err := CanStudyDeck(db, *deck, role, user.ID)
 				if err != nil {
-					return nil, err
+					c.String(http.StatusInternalServerError, "Failed to load the subscriptions")
+					restLogger.Error(err)
+					return
+				} else if !allowed {
+					c.String(http.StatusForbidden, "You need to subscribe to all the specified decks to study them")
+					return
 				}
+			}
 
-				// Copy repetitions
-				repetitions := []*mongo.Repetition{}
-				err = db.Repetitions.FindAll(bson.M{
-					"deckId": deck.ID,
-					"cardId": cardId,
-				}, &repetitions)
-				if err != nil {
-					return nil, err
-				}
+			// The owner's scheduling state and repetitions would otherwise be
+			// attributed to the owner of the new deck
+			if payload.Action == "move" && deck.Owner != newDeck.Owner {
+				c.String(http.StatusForbidden, "You can only move cards between decks with the same owner")
+				return
+			}
 
-				if len(repetitions) > 0 {
-					for _, repetition := range repetitions {
-						repetition.ID = primitive.NilObjectID
-						repetition.DeckID = newDeck.ID
-						repetition.CardId = card.ID
-						_, err = db.Repetitions.InsertOne(repetition)
+			schedulingUsers[deck.ID] = SchedulingUser(*deck, user.ID)
+			decksById[deck.ID] = deck
+		}
+
+		// Load the selected cards
+		cardFilters := []bson.M{}
+		for deckId, cardIds := range cardIdsByDeck {
+			cardFilters = append(cardFilters, bson.M{
+				"deckId": deckId,
+				"id":     bson.M{string(op.In): cardIds},
+			})
+		}
+		cards := []*mongo.Card{}
+		err = db.Cards.FindAll(bson.M{
+			string(op.Or): cardFilters,
+		}, &cards)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		} else if len(cards) != selectedCards {
+			c.String(http.StatusBadRequest, "Some of the specified cards do not exist")
+			return
+		}
+
+		cardObjectIds := make([]primitive.ObjectID, len(cards))
+		for i, card := range cards {
+			cardObjectIds[i] = card.BasicModel.ID
+		}
+		selection := bson.M{
+			"_id": bson.M{string(op.In): cardObjectIds},
+		}
+
+		// Apply the action to all the cards atomically
+		result, err := db.Transaction(
+			60*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				var err error
+				updatedCards := []mongo.Card{}
+
+				switch payload.Action {
+				case "pause", "unpause":
+					_, err = db.Cards.UpdateMany(selection, mongo.UpdateDocument{
+						op.Set: bson.M{
+							"paused": payload.Action == "pause",
+						},
+					})
+				case "addTag":
+					_, err = db.Cards.UpdateMany(selection, mongo.UpdateDocument{
+						op.AddToSet: bson.M{
+							"tags": payload.Tag,
+						},
+					})
+				case "removeTag":
+					_, err = db.Cards.UpdateMany(selection, mongo.UpdateDocument{
+						op.Pull: bson.M{
+							"tags": payload.Tag,
+						},
+					})
+				case "delete":
+					for _, card := range cards {
+						if _, err = TrashCard(db, *decksById[card.DeckID], *card, user.ID); err != nil {
+							break
+						}
+					}
+				case "reset":
+					for _, card := range cards {
+						if err = ResetCardScheduling(db, *card, schedulingUsers[card.DeckID]); err != nil {
+							break
+						}
+					}
+				case "move":
+					for _, card := range cards {
+						if card.DeckID == newDeckId {
+							updatedCards = append(updatedCards, *card)
+							continue
+						}
+
+						newCard, err := MoveCard(db, *card, newDeckId)
 						if err != nil {
 							return nil, err
 						}
+						updatedCards = append(updatedCards, newCard)
 					}
+				case "copy":
+					for _, card := range cards {
+						// The scheduling state copied is the one of the requesting user
+						copied := []mongo.Card{*card}
+						err = ApplyCardSchedules(db, *decksById[card.DeckID], user.ID, copied)
+						if err != nil {
+							return nil, err
+						}
 
-					err = db.Repetitions.InsertMany(repetitions)
-					if err != nil {
-						return nil, err
+						newCard, err := CopyCard(db, copied[0], schedulingUsers[card.DeckID], newDeckId)
+						if err != nil {
+							return nil, err
+						}
+						updatedCards = append(updatedCards, newCard)
 					}
 				}
+				if err != nil {
+					return nil, err
+				}
 
-				return card, nil
+				return updatedCards, nil
 			},
 		)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to delete card")
+			c.String(http.StatusInternalServerError, "Failed to update the cards")
 			restLogger.Error(err)
 			return
 		}
 
-		c.JSON(http.StatusOK, card)
+		c.JSON(http.StatusOK, result)
 	})
 
-	r.POST("/decks/:deckId/cards/:cardId/repetition", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Load user
-		exists, err, user := GetAuthenticatedUser(c, db)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
-			restLogger.Error(err)
-			return
-		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
-			return
-		}
-
-		// Load deck
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
-		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
-			return
-		}
-
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
-			restLogger.Error(err)
-			return
-		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
-			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
-			return
-		}
+	r.POST("/decks/:deckId/cards/:cardId/repetition", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), StudyAuthorized(db), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
 
 		// Parse payload
 		var payload struct {
 			Date    time.Time `json:"date"`
 			Quality int       `json:"quality"`
 		}
-		err = c.ShouldBindJSON(&payload)
+		err := c.ShouldBindJSON(&payload)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Invalid payload")
 			return
 		}
 		cardId := c.Param("cardId")
 
-		// Determine to which calendar day the repetition belongs
-		location, err := time.LoadLocation(user.Timezone)
+		// Load card
+		var card mongo.Card
+		exists, err := db.Cards.FindOneIfExists(bson.M{
+			"deckId": deck.ID,
+			"id":     cardId,
+		}, &card)
 		if err != nil {
-			log.Println(err)
-			location = time.UTC
+			c.String(http.StatusInternalServerError, "Failed to load the card")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusBadRequest, "The specified card does not exist")
+			return
 		}
-		dayOfRepetition := payload.Date.
-			Add(-time.Hour * time.Duration(user.EndOfDay)).
-			In(location).
-			Format("2006-01-02")
+
+		// Each collaborator has their own repetitions and scheduling state
+		schedulingUser := SchedulingUser(deck, user.ID)
+
+		// Determine to which calendar day the repetition belongs
+		dayOfRepetition := UserDay(user, payload.Date)
 
 		updates, err := db.Transaction(
 			30*time.Second,
@@ -639,6 +1110,7 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 				_, err := db.Repetitions.InsertOne(&mongo.Repetition{
 					CardId:  cardId,
 					DeckID:  deck.ID,
+					UserID:  schedulingUser,
 					Date:    payload.Date,
 					Quality: payload.Quality,
 				})
@@ -652,6 +1124,7 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 				err = db.Repetitions.FindAll(bson.M{
 					"cardId": cardId,
 					"deckId": deck.ID,
+					"userId": schedulingUser,
 				}, &repetitions)
 				if err != nil {
 					return nil, err
@@ -659,13 +1132,8 @@ func setupCardRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobSto
 
 				cardUpdate := processRepetitions(repetitions)
 
-				// Update the card with the new half-life and factor
-				_, err = db.Decks.UpdateOne(bson.M{
-					"_id":      deck.ID,
-					"cards.id": cardId,
-				}, mongo.UpdateDocument{
-					op.Set: cardUpdate,
-				})
+				// Update the scheduling state with the new half-life and factor
+				err = SaveCardSchedule(db, card, schedulingUser, cardUpdate)
 				if err != nil {
 					return nil, err
 				}
@@ -0,0 +1,220 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// SubscribedDeckIds returns the IDs of the published decks the user subscribed to
+func SubscribedDeckIds(db *mongo.Database, userId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	subscriptions := []*mongo.Subscription{}
+	err := db.Subscriptions.FindAll(bson.M{
+		"user": userId,
+	}, &subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	deckIds := make([]primitive.ObjectID, len(subscriptions))
+	for i, subscription := range subscriptions {
+		deckIds[i] = subscription.Deck
+	}
+
+	return deckIds, nil
+}
+
+// Unsubscribe deletes the subscription of the user to the deck and updates
+// the subscribers count, the scheduling state is kept in case the user
+// subscribes again. It should be called inside a transaction
+func Unsubscribe(db *mongo.Database, userId primitive.ObjectID, deckId primitive.ObjectID) (bool, error) {
+	deleted, err := db.Subscriptions.DeleteMany(bson.M{
+		"user": userId,
+		"deck": deckId,
+	})
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+
+	_, err = db.Decks.UpdateById(deckId, mongo.UpdateDocument{
+		op.Inc: bson.M{
+			"subscribers": -deleted,
+		},
+	})
+	return true, err
+}
+
+func setupCatalogRoutes(r *gin.Engine, db *mongo.Database) {
+	r.GET("/catalog", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Parse query parameters
+		var query struct {
+			Search string `form:"search"`
+			Limit  int    `form:"limit"`
+			Offset int    `form:"offset"`
+		}
+		err := c.ShouldBindQuery(&query)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid query: %s", err.Error())
+			return
+		} else if query.Offset < 0 {
+			c.String(http.StatusBadRequest, "The `offset` parameter cannot be negative")
+			return
+		}
+		if query.Limit <= 0 || query.Limit > 100 {
+			query.Limit = 20
+		}
+
+		entries, err := db.ListCatalog(mongo.CatalogQuery{
+			Search: query.Search,
+			Limit:  query.Limit,
+			Offset: query.Offset,
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the catalog")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, entries)
+	})
+
+	r.PUT("/decks/:deckId/publication", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		var payload struct {
+			Description string `json:"description"`
+		}
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid payload")
+			return
+		}
+
+		update := bson.M{
+			"published":   true,
+			"description": payload.Description,
+		}
+		if !deck.Published {
+			update["publishedAt"] = time.Now()
+		}
+
+		_, err = db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
+			op.Set: update,
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to publish the deck")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	r.DELETE("/decks/:deckId/publication", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// The subscriptions are kept so that they are restored if the deck is published again
+		_, err := db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
+			op.Set: bson.M{
+				"published": false,
+			},
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to unpublish the deck")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	r.POST("/decks/:deckId/subscription", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		isCollaborator := slices.ContainsFunc(deck.Collaborators, func(collaborator mongo.Collaborator) bool {
+			return collaborator.User == user.ID
+		})
+		if !deck.Published {
+			c.String(http.StatusBadRequest, "Only published decks can be subscribed to")
+			return
+		} else if deck.Owner == user.ID || isCollaborator {
+			c.String(http.StatusBadRequest, "You already have access to this deck")
+			return
+		}
+
+		_, err := db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				_, existed, err := db.Subscriptions.InsertOneIfNotExists(bson.M{
+					"user": user.ID,
+					"deck": deck.ID,
+				}, &mongo.Subscription{
+					User: user.ID,
+					Deck: deck.ID,
+				})
+				if err != nil || existed {
+					return nil, err
+				}
+
+				_, err = db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
+					op.Inc: bson.M{
+						"subscribers": 1,
+					},
+				})
+				return nil, err
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to subscribe to the deck")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	// Unsubscribing does not require access to the deck, since it
+	// should be possible also after the deck has been unpublished
+	r.DELETE("/decks/:deckId/subscription", Authenticated([]string{"user"}), func(c *gin.Context) {
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		rawId := c.Param("deckId")
+		deckId, err := primitive.ObjectIDFromHex(rawId)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid deck id")
+			return
+		}
+
+		subscribed, err := db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				return Unsubscribe(db, user.ID, deckId)
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to unsubscribe from the deck")
+			restLogger.Error(err)
+			return
+		} else if !subscribed.(bool) {
+			c.String(http.StatusBadRequest, "You are not subscribed to this deck")
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+}
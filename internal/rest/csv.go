@@ -0,0 +1,349 @@
+package rest
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxCSVImportSize is the maximum size in bytes of an imported CSV file
+const MaxCSVImportSize = 20 * 1024 * 1024
+
+// MaxImportCards is the maximum number of cards that can be imported from a single file
+const MaxImportCards = 10000
+
+// CSVTagSeparator separates the tags of a card in the tags column
+const CSVTagSeparator = ";"
+
+// ParseCSVDelimiter returns the delimiter specified by the query parameter,
+// which is a single character or "tab", the default delimiter is the comma
+func ParseCSVDelimiter(value string) (rune, error) {
+	switch value {
+	case "":
+		return ',', nil
+	case "tab", "\t":
+		return '\t', nil
+	}
+
+	delimiter, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+		return 0, fmt.Errorf("the delimiter must be a single character other than quotes and newlines, or \"tab\"")
+	}
+
+	return delimiter, nil
+}
+
+// parseCSVPaused parses the value of the paused column, an empty value means the card is not paused
+func parseCSVPaused(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "0", "false", "no", "n":
+		return false, nil
+	case "1", "true", "yes", "y":
+		return true, nil
+	}
+
+	return false, fmt.Errorf("the paused column must be true or false, got %q", value)
+}
+
+// parseCSVTags splits the value of the tags column, skipping the empty tags
+func parseCSVTags(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(value, CSVTagSeparator) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// CSVRow is a card parsed from a row of an imported file, Line is the line
+// where the row starts and Error is set if the row cannot be imported
+type CSVRow struct {
+	Line   int      `json:"line"`
+	ID     string   `json:"id,omitempty"`
+	Front  string   `json:"front"`
+	Back   string   `json:"back"`
+	Tags   []string `json:"tags"`
+	Paused bool     `json:"paused"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// CSVColumns are the names of the header columns mapped to the fields of the cards,
+// the tags and paused columns are optional: if their names are empty the columns
+// named "tags" and "paused" are used when present
+type CSVColumns struct {
+	Front  string
+	Back   string
+	Tags   string
+	Paused string
+}
+
+// ParseCSVCards reads the cards from a file with a header row, the rows that
+// cannot be parsed are returned with an error instead of failing the whole file
+func ParseCSVCards(reader io.Reader, delimiter rune, columns CSVColumns) ([]CSVRow, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.Comma = delimiter
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the file is empty")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse the header: %w", err)
+	}
+
+	// Find the position of the mapped columns, the names are case insensitive
+	positions := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+	position := func(column string, fallback string) (int, error) {
+		if column == "" && fallback == "" {
+			return -1, fmt.Errorf("the front and back columns must be specified")
+		} else if column == "" {
+			if i, ok := positions[fallback]; ok {
+				return i, nil
+			}
+			return -1, nil
+		}
+
+		i, ok := positions[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			return -1, fmt.Errorf("the header has no %q column", column)
+		}
+		return i, nil
+	}
+	frontColumn, err := position(columns.Front, "")
+	if err != nil {
+		return nil, err
+	}
+	backColumn, err := position(columns.Back, "")
+	if err != nil {
+		return nil, err
+	}
+	tagsColumn, err := position(columns.Tags, "tags")
+	if err != nil {
+		return nil, err
+	}
+	pausedColumn, err := position(columns.Paused, "paused")
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []CSVRow{}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			rows = append(rows, CSVRow{
+				Line:  parseError.StartLine,
+				Tags:  []string{},
+				Error: parseError.Err.Error(),
+			})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		row := CSVRow{Line: line, Tags: []string{}}
+		field := func(i int) string {
+			if i < 0 || i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+
+		row.Front = field(frontColumn)
+		row.Back = field(backColumn)
+		row.Tags = parseCSVTags(field(tagsColumn))
+		row.Paused, err = parseCSVPaused(field(pausedColumn))
+		if len(record) <= frontColumn || len(record) <= backColumn {
+			row.Error = fmt.Sprintf("the row has %d columns, the front and back columns are missing", len(record))
+		} else if err != nil {
+			row.Error = err.Error()
+		} else if strings.TrimSpace(row.Front) == "" && strings.TrimSpace(row.Back) == "" {
+			row.Error = "the card is empty"
+		}
+		rows = append(rows, row)
+
+		if len(rows) > MaxImportCards {
+			return nil, fmt.Errorf("the file cannot contain more than %d cards", MaxImportCards)
+		}
+	}
+
+	return rows, nil
+}
+
+func setupCSVRoutes(r *gin.Engine, db *mongo.Database, blobStorage storage.BlobStorage) {
+	r.GET("/decks/:deckId/export.csv", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		delimiter, err := ParseCSVDelimiter(c.Query("delimiter"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		cards, err := LoadCards(db, []primitive.ObjectID{deck.ID})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		// Prepare the rows before writing, so that failures can still be reported.
+		// The images keep their blob ID, so that they are preserved when the file
+		// is imported again, and get a signed link to be viewable elsewhere
+		records := [][]string{{"front", "back", "tags", "paused"}}
+		for i := range cards {
+			card := &cards[i]
+			err = SignCardImages(card, blobStorage)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to sign the image links")
+				restLogger.Error(err)
+				return
+			}
+			front, err := HTMLFragment(card.Front)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to export the cards")
+				restLogger.Error(err)
+				return
+			}
+			back, err := HTMLFragment(card.Back)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to export the cards")
+				restLogger.Error(err)
+				return
+			}
+
+			records = append(records, []string{
+				front,
+				back,
+				strings.Join(card.Tags, CSVTagSeparator),
+				strconv.FormatBool(card.Paused),
+			})
+		}
+
+		extension := "csv"
+		contentType := "text/csv"
+		if delimiter == '\t' {
+			extension = "tsv"
+			contentType = "text/tab-separated-values"
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, exportFilename(deck.Name), extension))
+		c.Header("Content-Type", contentType+"; charset=utf-8")
+		c.Status(http.StatusOK)
+
+		writer := csv.NewWriter(c.Writer)
+		writer.Comma = delimiter
+		err = writer.WriteAll(records)
+		if err != nil {
+			restLogger.Error(err)
+		}
+	})
+
+	r.POST("/decks/:deckId/import", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// Parse the options, the columns default to the names used by the export
+		delimiter, err := ParseCSVDelimiter(c.Query("delimiter"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		columns := CSVColumns{
+			Front:  c.DefaultQuery("front", "front"),
+			Back:   c.DefaultQuery("back", "back"),
+			Tags:   c.Query("tags"),
+			Paused: c.Query("paused"),
+		}
+		dryRun := c.Query("dryRun") == "true"
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxCSVImportSize)
+		file, _, err := c.Request.FormFile("file")
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.String(http.StatusRequestEntityTooLarge, "The file cannot be larger than %d bytes", MaxCSVImportSize)
+			return
+		} else if err != nil {
+			c.String(http.StatusBadRequest, "The request must contain the file in the `file` field")
+			return
+		}
+		defer file.Close()
+
+		rows, err := ParseCSVCards(file, delimiter, columns)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// The preview reports the parsed rows without creating the cards
+		if dryRun {
+			c.JSON(http.StatusOK, rows)
+			return
+		}
+
+		// Create the cards with the same image processing used by the card routes
+		newCards := []*mongo.Card{}
+		userStorage := UserStorage(db, blobStorage, user)
+		for i := range rows {
+			row := &rows[i]
+			if row.Error != "" {
+				continue
+			}
+
+			newCard, err := NewCard(deck.ID, row.Front, row.Back, userStorage)
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				row.Error = "The images exceed the storage quota of your plan"
+				continue
+			} else if err != nil {
+				row.Error = "Failed to replace base64 images with file links"
+				restLogger.Error(err)
+				continue
+			}
+			newCard.Paused = row.Paused
+			newCard.Tags = row.Tags
+
+			row.ID = newCard.ID
+			newCards = append(newCards, newCard)
+		}
+
+		if len(newCards) > 0 {
+			err = db.Cards.InsertMany(newCards)
+			if err != nil {
+				media := []string{}
+				for _, card := range newCards {
+					media = append(media, CardMedia(*card)...)
+				}
+				ReleaseUnusedMedia(db, blobStorage, media)
+
+				c.String(http.StatusInternalServerError, "Failed to save cards")
+				restLogger.Error(err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, rows)
+	})
+}
@@ -1,17 +1,24 @@
 package rest
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/ZaninAndrea/binder-server/internal/mongo"
 	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
 )
 
-func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
+func setupDeckRoutes(r *gin.Engine, db *mongo.Database, storage storage.BlobStorage) {
 	r.POST("/decks", Authenticated([]string{"user"}), func(c *gin.Context) {
 		exists, err, user := GetAuthenticatedUser(c, db)
 		if err != nil {
@@ -24,7 +31,8 @@ func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
 		}
 
 		var payload struct {
-			Name string
+			Name   string
+			Parent string
 		}
 		err = c.ShouldBindJSON(&payload)
 		if err != nil {
@@ -35,12 +43,34 @@ func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
 			return
 		}
 
-		deckId, err := db.Decks.InsertOne(&mongo.Deck{
+		newDeck := mongo.Deck{
 			Name:     payload.Name,
 			Archived: false,
 			Cards:    []mongo.Card{},
 			Owner:    user.ID,
-		})
+		}
+
+		// Nest the deck inside the parent if specified
+		if payload.Parent != "" {
+			parentId, err := primitive.ObjectIDFromHex(payload.Parent)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid parent deck id")
+				return
+			}
+
+			err = ValidateDeckParent(db, newDeck, parentId)
+			if errors.Is(err, ErrParentNotFound) || errors.Is(err, ErrParentNotOwned) {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			} else if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the parent deck")
+				restLogger.Error(err)
+				return
+			}
+			newDeck.Parent = &parentId
+		}
+
+		deckId, err := db.Decks.InsertOne(&newDeck)
 
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to create the deck")
@@ -62,20 +92,62 @@ func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
 			return
 		}
 
+		// Load the decks owned by the user, shared with them or subscribed
+		subscribedIds, err := SubscribedDeckIds(db, user.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the subscriptions")
+			restLogger.Error(err)
+			return
+		}
+
 		decks := []*mongo.Deck{}
-		err = db.Decks.FindAll(bson.M{
-			"owner": user.ID,
-		}, &decks)
+		err = db.Decks.FindAll(UserDecksFilter(user.ID, subscribedIds), &decks)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to load the decks")
 			restLogger.Error(err)
 			return
 		}
 
+		err = LoadDeckCards(db, decks)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		for _, deck := range decks {
+			deck.Role, err = DeckRoleOf(db, *deck, user.ID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the decks")
+				restLogger.Error(err)
+				return
+			}
+			VisibleDeck(deck)
+
+			err = ApplyCardSchedules(db, *deck, user.ID, deck.Cards)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the scheduling state")
+				restLogger.Error(err)
+				return
+			}
+		}
+
+		// Replace the image references with signed links
+		for _, deck := range decks {
+			for i := range deck.Cards {
+				err = SignCardImages(&deck.Cards[i], storage)
+				if err != nil {
+					c.String(http.StatusInternalServerError, "Failed to sign the image links")
+					restLogger.Error(err)
+					return
+				}
+			}
+		}
+
 		c.JSON(http.StatusOK, decks)
 	})
 
-	r.GET("/decks/:deckId", Authenticated([]string{"user"}), func(c *gin.Context) {
+	r.GET("/decks/summary", Authenticated([]string{"user"}), func(c *gin.Context) {
 		exists, err, user := GetAuthenticatedUser(c, db)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to load the user")
@@ -86,73 +158,247 @@ func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
 			return
 		}
 
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
+		// Parse query parameters
+		var query struct {
+			Archived *bool  `form:"archived"`
+			Sort     string `form:"sort"`
+			Order    string `form:"order"`
+			Limit    int    `form:"limit"`
+			Cursor   string `form:"cursor"`
+		}
+		err = c.ShouldBindQuery(&query)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
+			c.String(http.StatusBadRequest, "Invalid query: %s", err.Error())
 			return
+		} else if query.Order != "" && query.Order != "asc" && query.Order != "desc" {
+			c.String(http.StatusBadRequest, "The `order` parameter must be either `asc` or `desc`")
+			return
+		}
+		if query.Sort == "" {
+			query.Sort = "name"
+		}
+		if query.Limit <= 0 || query.Limit > 200 {
+			query.Limit = 50
 		}
 
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		subscribedIds, err := SubscribedDeckIds(db, user.ID)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			c.String(http.StatusInternalServerError, "Failed to load the subscriptions")
 			restLogger.Error(err)
 			return
-		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
+		}
+
+		summaries, nextCursor, err := db.ListDeckSummaries(mongo.DeckSummaryQuery{
+			User:       user.ID,
+			Subscribed: subscribedIds,
+			Archived:   query.Archived,
+			SortBy:     query.Sort,
+			Descending: query.Order == "desc",
+			Limit:      query.Limit,
+			Cursor:     query.Cursor,
+		}, time.Now())
+		if errors.Is(err, mongo.ErrInvalidCursor) || errors.Is(err, mongo.ErrInvalidSortField) {
+			c.String(http.StatusBadRequest, err.Error())
 			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the decks")
+			restLogger.Error(err)
 			return
 		}
 
-		c.JSON(http.StatusOK, deck)
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"decks":      summaries,
+			"nextCursor": nextCursor,
+		})
 	})
 
-	r.PUT("/decks/:deckId", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Check that the authenticated user exists
-		exists, err, user := GetAuthenticatedUser(c, db)
+	r.GET("/decks/:deckId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// The cards of the sub-decks are included unless requested otherwise
+		deckIds := []primitive.ObjectID{deck.ID}
+		if c.Query("includeSubdecks") != "false" {
+			descendants, err := DescendantDeckIds(db, deck.ID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the sub-decks")
+				restLogger.Error(err)
+				return
+			}
+			deckIds = append(deckIds, descendants...)
+		}
+
+		cards, err := LoadCards(db, deckIds)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
 			restLogger.Error(err)
 			return
-		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
-			return
 		}
+		deck.Cards = cards
+		VisibleDeck(&deck)
 
-		// Parse query parameters
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
+		err = ApplyCardSchedules(db, deck, user.ID, deck.Cards)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
+			c.String(http.StatusInternalServerError, "Failed to load the scheduling state")
+			restLogger.Error(err)
 			return
 		}
 
+		// Replace the image references with signed links
+		for i := range deck.Cards {
+			err = SignCardImages(&deck.Cards[i], storage)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to sign the image links")
+				restLogger.Error(err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, deck)
+	})
+
+	r.POST("/decks/:deckId/duplicate", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
 		// Parse the payload
-		var query struct {
-			Archived *bool   `json:"archived"`
-			Name     *string `json:"name"`
+		var payload struct {
+			Name              *string `json:"name"`
+			IncludeScheduling bool    `json:"includeScheduling"`
 		}
-		err = c.ShouldBindJSON(&query)
-		if err != nil {
+		// The payload is optional
+		err := c.ShouldBindJSON(&payload)
+		if err != nil && !errors.Is(err, io.EOF) {
 			c.String(http.StatusBadRequest, "Invalid body: %s", err.Error())
 			return
+		} else if payload.Name != nil && *payload.Name == "" {
+			c.String(http.StatusBadRequest, "You must specify an non-empty `name` field")
+			return
 		}
 
-		// Check that the authenticated user is the deck's owner
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		err = LoadDeckCards(db, []*mongo.Deck{&deck})
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
 			restLogger.Error(err)
 			return
-		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
+		}
+
+		// The scheduling state copied is the one of the requesting user
+		schedulingUser := SchedulingUser(deck, user.ID)
+		err = ApplyCardSchedules(db, deck, user.ID, deck.Cards)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the scheduling state")
+			restLogger.Error(err)
+			return
+		}
+
+		name := deck.Name + " (copy)"
+		if payload.Name != nil {
+			name = *payload.Name
+		}
+
+		// Copy the deck and its cards, the images are shared between the
+		// two decks since a blob is deleted only once no card references it
+		newDeckId, err := db.Transaction(
+			60*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				newDeckId, err := db.Decks.InsertOne(&mongo.Deck{
+					Name:     name,
+					Archived: false,
+					Owner:    user.ID,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				if len(deck.Cards) == 0 {
+					return newDeckId, nil
+				}
+
+				newCardIds := map[string]string{}
+				newCards := make([]*mongo.Card, len(deck.Cards))
+				for i := range deck.Cards {
+					card := deck.Cards[i]
+					newCardIds[card.ID] = uuid.NewString()
+					card.ID = newCardIds[card.ID]
+					card.DeckID = newDeckId
+
+					if !payload.IncludeScheduling {
+						card.Factor = 2.5
+						card.HalfLife = 0
+						card.TotalRepetitions = 0
+						card.CorrectRepetitions = 0
+						card.LastRepetition = nil
+						card.DueAt = nil
+					}
+
+					newCards[i] = &card
+				}
+
+				err = db.Cards.InsertMany(newCards)
+				if err != nil {
+					return nil, err
+				}
+
+				if !payload.IncludeScheduling {
+					return newDeckId, nil
+				}
+
+				// Copy the repetitions history
+				repetitions := []*mongo.Repetition{}
+				err = db.Repetitions.FindAll(bson.M{
+					"deckId": deck.ID,
+					"userId": schedulingUser,
+				}, &repetitions)
+				if err != nil {
+					return nil, err
+				}
+
+				newRepetitions := []*mongo.Repetition{}
+				for _, repetition := range repetitions {
+					newCardId, ok := newCardIds[repetition.CardId]
+					if !ok {
+						continue
+					}
+
+					repetition.DeckID = newDeckId
+					repetition.CardId = newCardId
+					repetition.UserID = nil
+					newRepetitions = append(newRepetitions, repetition)
+				}
+
+				if len(newRepetitions) > 0 {
+					err = db.Repetitions.InsertMany(newRepetitions)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				return newDeckId, nil
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to duplicate the deck")
+			restLogger.Error(err)
 			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
+		}
+
+		c.String(http.StatusOK, newDeckId.(primitive.ObjectID).Hex())
+	})
+
+	r.PUT("/decks/:deckId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// Parse the payload
+		var query struct {
+			Archived *bool   `json:"archived"`
+			Name     *string `json:"name"`
+			// Parent is the new parent deck, an empty string moves the deck to the top level
+			Parent *string `json:"parent"`
+		}
+		err := c.ShouldBindJSON(&query)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid body: %s", err.Error())
 			return
 		}
 
@@ -164,6 +410,26 @@ func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
 		if query.Name != nil {
 			update["name"] = *query.Name
 		}
+		if query.Parent != nil && *query.Parent == "" {
+			update["parent"] = nil
+		} else if query.Parent != nil {
+			parentId, err := primitive.ObjectIDFromHex(*query.Parent)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid parent deck id")
+				return
+			}
+
+			err = ValidateDeckParent(db, deck, parentId)
+			if errors.Is(err, ErrParentNotFound) || errors.Is(err, ErrParentNotOwned) || errors.Is(err, ErrDeckCycle) {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			} else if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the parent deck")
+				restLogger.Error(err)
+				return
+			}
+			update["parent"] = parentId
+		}
 		_, err = db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
 			op.Set: update,
 		})
@@ -176,67 +442,405 @@ func setupDeckRoutes(r *gin.Engine, db *mongo.Database) {
 		c.String(http.StatusOK, "")
 	})
 
-	r.DELETE("/decks/:deckId", Authenticated([]string{"user"}), func(c *gin.Context) {
-		// Check that the authenticated user exists
-		exists, err, user := GetAuthenticatedUser(c, db)
+	r.DELETE("/decks/:deckId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// The sub-decks are either deleted too or moved to the deck's parent
+		children := c.DefaultQuery("children", "reparent")
+		deckIds := []primitive.ObjectID{deck.ID}
+		switch children {
+		case "cascade":
+			descendants, err := DescendantDeckIds(db, deck.ID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the sub-decks")
+				restLogger.Error(err)
+				return
+			}
+			deckIds = append(deckIds, descendants...)
+		case "reparent":
+		default:
+			c.String(http.StatusBadRequest, "The `children` parameter must be either `cascade` or `reparent`")
+			return
+		}
+
+		// The decks are moved to the trash, the cards and repetitions are
+		// deleted when the trash item is purged
+		item, err := db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				return TrashDeck(db, deck, deckIds, user.ID)
+			},
+		)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the user")
+			c.String(http.StatusInternalServerError, "Failed to delete the deck")
 			restLogger.Error(err)
 			return
-		} else if !exists {
-			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+		}
+
+		// The ID of the trash item allows undoing the deletion
+		c.String(http.StatusOK, item.(*mongo.TrashItem).ID.Hex())
+	})
+
+	// Merging moves all the cards of the source deck, with the repetitions and the
+	// scheduling state of the collaborators, into this deck and trashes the source.
+	// Both decks must be owned by the user, not just shared with the owner role, since
+	// the repetitions of the owner are stored without userId and would otherwise be
+	// attributed to another user
+	r.POST("/decks/:deckId/merge", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		var payload struct {
+			SourceDeckId string `json:"sourceDeckId"`
+		}
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid payload")
 			return
 		}
 
-		// Parse query parameters
-		rawId := c.Param("deckId")
-		deckId, err := primitive.ObjectIDFromHex(rawId)
+		sourceDeckId, err := primitive.ObjectIDFromHex(payload.SourceDeckId)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Invalid deck id")
+			c.String(http.StatusBadRequest, "Invalid source deck id")
+			return
+		} else if sourceDeckId == deck.ID {
+			c.String(http.StatusBadRequest, "A deck cannot be merged into itself")
 			return
 		}
 
-		// Check that the authenticated user is the deck's owner
-		var deck mongo.Deck
-		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		var sourceDeck mongo.Deck
+		exists, err := db.Decks.FindByIdIfExists(sourceDeckId, &sourceDeck)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			c.String(http.StatusInternalServerError, "Failed to load the source deck")
 			restLogger.Error(err)
 			return
 		} else if !exists {
-			c.String(http.StatusBadRequest, "The specified deck does not exist")
+			c.String(http.StatusBadRequest, "The specified source deck does not exist")
 			return
-		} else if deck.Owner != user.ID {
-			c.String(http.StatusUnauthorized, "You are not the owner of this deck")
+		}
+
+		// A collaborator with the owner role does not own the deck, so the
+		// repetitions of the source would be attributed to the actual owner
+		if deck.Owner != user.ID || sourceDeck.Owner != user.ID {
+			c.String(http.StatusForbidden, "You can only merge decks that you own")
 			return
 		}
 
-		// Delete the deck and the associated repetitions
-		_, err = db.Transaction(
-			30*time.Second,
+		type mergeResult struct {
+			Cards       int64  `json:"cards"`
+			TrashItemId string `json:"trashItemId"`
+		}
+		result, err := db.Transaction(
+			60*time.Second,
 			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
-				_, err := db.Decks.DeleteById(deck.ID)
+				moved, err := MoveCards(db, sourceDeck.ID, nil, deck.ID)
 				if err != nil {
 					return nil, err
 				}
 
-				_, err = db.Repetitions.DeleteMany(bson.M{
-					"deckId": deck.ID,
+				// The cards trashed from the source deck are restored in this deck
+				_, err = db.Trash.UpdateMany(bson.M{
+					"type":   mongo.TrashedCard,
+					"deckId": sourceDeck.ID,
+				}, mongo.UpdateDocument{
+					op.Set: bson.M{
+						"deckId":      deck.ID,
+						"card.deckId": deck.ID,
+					},
 				})
 				if err != nil {
 					return nil, err
 				}
 
-				return nil, nil
+				item, err := TrashDeck(db, sourceDeck, []primitive.ObjectID{sourceDeck.ID}, user.ID)
+				if err != nil {
+					return nil, err
+				}
+
+				return mergeResult{
+					Cards:       moved,
+					TrashItemId: item.ID.Hex(),
+				}, nil
 			},
 		)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "Failed to delete the deck")
+			c.String(http.StatusInternalServerError, "Failed to merge the decks")
 			restLogger.Error(err)
 			return
 		}
 
-		c.String(http.StatusOK, "")
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Splitting moves the cards matching a tag and/or a search text, with the repetitions
+	// and the scheduling state of the collaborators, into a new sibling deck
+	r.POST("/decks/:deckId/split", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		var payload struct {
+			Name   string `json:"name"`
+			Tag    string `json:"tag"`
+			Search string `json:"search"`
+		}
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid payload")
+			return
+		} else if payload.Name == "" {
+			c.String(http.StatusBadRequest, "You must specify an non-empty `name` field")
+			return
+		} else if payload.Tag == "" && payload.Search == "" {
+			c.String(http.StatusBadRequest, "You must specify a `tag` or a `search` field")
+			return
+		}
+
+		filter := bson.M{"deckId": deck.ID}
+		if payload.Tag != "" {
+			filter["tags"] = payload.Tag
+		}
+		cards := []*mongo.Card{}
+		err = db.Cards.FindAll(filter, &cards)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		// The search matches the text of the cards, ignoring the HTML markup
+		search := strings.ToLower(payload.Search)
+		cardIds := []string{}
+		for _, card := range cards {
+			if search != "" &&
+				!strings.Contains(strings.ToLower(StripHTML(card.Front)), search) &&
+				!strings.Contains(strings.ToLower(StripHTML(card.Back)), search) {
+				continue
+			}
+			cardIds = append(cardIds, card.ID)
+		}
+		if len(cardIds) == 0 {
+			c.String(http.StatusBadRequest, "No card matches the filter")
+			return
+		}
+
+		// The collaborators keep access to the cards they were studying
+		type splitResult struct {
+			DeckId string `json:"deckId"`
+			Cards  int64  `json:"cards"`
+		}
+		result, err := db.Transaction(
+			60*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				newDeckId, err := db.Decks.InsertOne(&mongo.Deck{
+					Name:          payload.Name,
+					Archived:      false,
+					Owner:         deck.Owner,
+					Parent:        deck.Parent,
+					Collaborators: deck.Collaborators,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				moved, err := MoveCards(db, deck.ID, cardIds, newDeckId)
+				if err != nil {
+					return nil, err
+				}
+
+				return splitResult{
+					DeckId: newDeckId.Hex(),
+					Cards:  moved,
+				}, nil
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to split the deck")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	})
+
+}
+
+// LoadDeckCards fills the Cards field of the decks with the
+// cards stored in the cards collection
+func LoadDeckCards(db *mongo.Database, decks []*mongo.Deck) error {
+	if len(decks) == 0 {
+		return nil
+	}
+
+	deckIds := make([]primitive.ObjectID, len(decks))
+	decksById := map[primitive.ObjectID]*mongo.Deck{}
+	for i, deck := range decks {
+		deckIds[i] = deck.ID
+		decksById[deck.ID] = deck
+		deck.Cards = []mongo.Card{}
+	}
+
+	cards := []*mongo.Card{}
+	err := db.Cards.FindAll(bson.M{
+		"deckId": bson.M{
+			string(op.In): deckIds,
+		},
+	}, &cards)
+	if err != nil {
+		return err
+	}
+
+	for _, card := range cards {
+		deck := decksById[card.DeckID]
+		deck.Cards = append(deck.Cards, *card)
+	}
+
+	return nil
+}
+
+// LoadCards returns all the cards contained in the specified decks
+func LoadCards(db *mongo.Database, deckIds []primitive.ObjectID) ([]mongo.Card, error) {
+	cards := []*mongo.Card{}
+	err := db.Cards.FindAll(bson.M{
+		"deckId": bson.M{
+			string(op.In): deckIds,
+		},
+	}, &cards)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]mongo.Card, len(cards))
+	for i, card := range cards {
+		result[i] = *card
+	}
+
+	return result, nil
+}
+
+// DescendantDeckIds returns the IDs of all the sub-decks nested,
+// directly or indirectly, inside the deck
+func DescendantDeckIds(db *mongo.Database, deckId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	descendants := []primitive.ObjectID{}
+	frontier := []primitive.ObjectID{deckId}
+
+	for len(frontier) > 0 {
+		children := []*mongo.Deck{}
+		err := db.Decks.FindAll(bson.M{
+			"parent": bson.M{
+				string(op.In): frontier,
+			},
+		}, &children)
+		if err != nil {
+			return nil, err
+		}
+
+		frontier = []primitive.ObjectID{}
+		for _, child := range children {
+			if !slices.Contains(descendants, child.ID) {
+				descendants = append(descendants, child.ID)
+				frontier = append(frontier, child.ID)
+			}
+		}
+	}
+
+	return descendants, nil
+}
+
+var ErrParentNotFound error = fmt.Errorf("the specified parent deck does not exist")
+var ErrParentNotOwned error = fmt.Errorf("you are not the owner of the parent deck")
+var ErrDeckCycle error = fmt.Errorf("a deck cannot be nested inside itself or its sub-decks")
+
+// DeleteDecks permanently deletes the decks with their cards, repetitions, scheduling
+// states, subscriptions, share links and snapshots, and returns the images that
+// may no longer be used. It should be called inside a transaction
+func DeleteDecks(db *mongo.Database, deckIds []primitive.ObjectID) ([]string, error) {
+	cards, err := LoadCards(db, deckIds)
+	if err != nil {
+		return nil, err
+	}
+	media := []string{}
+	for _, card := range cards {
+		media = append(media, CardMedia(card)...)
+	}
+
+	_, err = db.Decks.DeleteMany(bson.M{
+		"_id": bson.M{string(op.In): deckIds},
 	})
+	if err != nil {
+		return nil, err
+	}
 
+	_, err = db.Cards.DeleteMany(bson.M{
+		"deckId": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Repetitions.DeleteMany(bson.M{
+		"deckId": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Schedules.DeleteMany(bson.M{
+		"deckId": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Subscriptions.DeleteMany(bson.M{
+		"deck": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ShareLinks.DeleteMany(bson.M{
+		"deck": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotMedia, err := DeleteDeckSnapshots(db, deckIds)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(media, snapshotMedia...), nil
+}
+
+// ValidateDeckParent checks that the parent deck belongs to the owner of the
+// deck and that nesting the deck inside it does not create a cycle
+func ValidateDeckParent(db *mongo.Database, deck mongo.Deck, parentId primitive.ObjectID) error {
+	var parent mongo.Deck
+	exists, err := db.Decks.FindByIdIfExists(parentId, &parent)
+	if err != nil {
+		return err
+	} else if !exists {
+		return ErrParentNotFound
+	} else if parent.Owner != deck.Owner {
+		return ErrParentNotOwned
+	}
+
+	// Walk up the ancestors of the parent looking for the deck
+	visited := []primitive.ObjectID{}
+	for {
+		if parent.ID == deck.ID {
+			return ErrDeckCycle
+		} else if parent.Parent == nil || slices.Contains(visited, parent.ID) {
+			return nil
+		}
+		visited = append(visited, parent.ID)
+
+		err := db.Decks.FindById(*parent.Parent, &parent)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
 }
@@ -3,18 +3,28 @@ package rest
 import (
 	"bytes"
 	"encoding/base64"
+	"io"
+	"path"
 	"strings"
+	"time"
 
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
 	"github.com/ZaninAndrea/binder-server/storage"
 	"github.com/google/uuid"
 	"golang.org/x/exp/slices"
 	"golang.org/x/net/html"
 )
 
-// ReplaceBase64ImagesWithFileLinks replaces base64 encoded images in the given HTML content with file links
-func ReplaceBase64ImagesWithFileLinks(content string, storage *storage.BlobStorage) (string, error) {
+// SignedURLValidity is how long the image links returned to the clients remain valid
+const SignedURLValidity = 1 * time.Hour
+
+// ReplaceBase64ImagesWithFileLinks uploads the base64 encoded images in the given
+// HTML content to the storage and replaces them with a reference to the blob,
+// the src attribute is stripped from all the images stored in the blob storage
+func ReplaceBase64ImagesWithFileLinks(content string, storage storage.BlobStorage) (string, error) {
 	doc, _ := html.Parse(strings.NewReader(content))
 
+	uploaded := []string{}
 	var crawlNode func(*html.Node) error
 	crawlNode = func(node *html.Node) error {
 		if node.Type == html.ElementNode && node.Data == "img" {
@@ -38,12 +48,18 @@ func ReplaceBase64ImagesWithFileLinks(content string, storage *storage.BlobStora
 					if err != nil {
 						return err
 					}
+					uploaded = append(uploaded, ID)
 
-					// Replace the src attribute with the file link
-					node.Attr[i].Val = storage.DownloadURL(ID)
+					// Replace the src attribute with the blob ID
+					node.Attr[i].Val = ""
 					node.Attr = append(node.Attr, html.Attribute{Key: "az-blob-id", Val: ID})
 				}
 			}
+
+			// The links to the blobs expire, so only the blob ID is stored
+			if getAttribute(node, "az-blob-id") != "" {
+				removeAttribute(node, "src")
+			}
 			return nil
 		}
 		for child := node.FirstChild; child != nil; child = child.NextSibling {
@@ -55,6 +71,10 @@ func ReplaceBase64ImagesWithFileLinks(content string, storage *storage.BlobStora
 		return nil
 	}
 	if err := crawlNode(doc); err != nil {
+		// The images uploaded before the failure are not referenced by anything
+		for _, ID := range uploaded {
+			_ = storage.Delete(ID)
+		}
 		return "", err
 	}
 
@@ -67,6 +87,262 @@ func ReplaceBase64ImagesWithFileLinks(content string, storage *storage.BlobStora
 	return b.String(), nil
 }
 
+// SignImageLinks sets the src attribute of all the images stored in the
+// blob storage to a signed URL that expires after SignedURLValidity
+func SignImageLinks(content string, storage storage.BlobStorage) (string, error) {
+	if !strings.Contains(content, "az-blob-id") {
+		return content, nil
+	}
+
+	doc, _ := html.Parse(strings.NewReader(content))
+
+	var crawlNode func(*html.Node) error
+	crawlNode = func(node *html.Node) error {
+		if node.Type == html.ElementNode && node.Data == "img" {
+			blobID := getAttribute(node, "az-blob-id")
+			if blobID == "" {
+				return nil
+			}
+
+			url, err := storage.SignedURL(blobID, SignedURLValidity)
+			if err != nil {
+				return err
+			}
+			removeAttribute(node, "src")
+			node.Attr = append(node.Attr, html.Attribute{Key: "src", Val: url})
+
+			return nil
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if err := crawlNode(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+	if err := crawlNode(doc); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	err := html.Render(&b, doc)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// SignCardImages replaces the image links in the front and back of the card with signed URLs
+func SignCardImages(card *mongo.Card, storage storage.BlobStorage) error {
+	front, err := SignImageLinks(card.Front, storage)
+	if err != nil {
+		return err
+	}
+
+	back, err := SignImageLinks(card.Back, storage)
+	if err != nil {
+		return err
+	}
+
+	card.Front = front
+	card.Back = back
+	return nil
+}
+
+// MediaSource provides the files referenced by filename in imported content
+type MediaSource interface {
+	// OpenMedia opens the file with the given name, the boolean is false if it does not exist
+	OpenMedia(name string) (io.ReadCloser, bool, error)
+}
+
+// ReplaceMediaFiles uploads the images referenced by filename in the HTML
+// content and replaces them with a reference to the blob, the uploaded map
+// caches the blob IDs of the files already uploaded. Sounds are left untouched
+func ReplaceMediaFiles(content string, source MediaSource, storage storage.BlobStorage, uploaded map[string]string) (string, error) {
+	if !strings.Contains(content, "<img") {
+		return content, nil
+	}
+
+	doc, _ := html.Parse(strings.NewReader(content))
+
+	var crawlNode func(*html.Node) error
+	crawlNode = func(node *html.Node) error {
+		if node.Type == html.ElementNode && node.Data == "img" {
+			filename := getAttribute(node, "src")
+			if filename == "" || strings.Contains(filename, ":") {
+				return nil
+			}
+
+			blobID, ok := uploaded[filename]
+			if !ok {
+				reader, exists, err := source.OpenMedia(filename)
+				if err != nil {
+					return err
+				} else if !exists {
+					return nil
+				}
+
+				blobID = uuid.NewString() + strings.ToLower(path.Ext(filename))
+				err = storage.Upload(blobID, reader)
+				reader.Close()
+				if err != nil {
+					return err
+				}
+				uploaded[filename] = blobID
+			}
+
+			removeAttribute(node, "src")
+			node.Attr = append(node.Attr, html.Attribute{Key: "az-blob-id", Val: blobID})
+			return nil
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if err := crawlNode(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+	if err := crawlNode(doc); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	err := html.Render(&b, doc)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// ExportMediaFiles replaces the references to the blobs in the HTML content with
+// references by filename, relative to the given directory, and returns the
+// referenced blobs. Only the content of the body is returned
+func ExportMediaFiles(content string, dir string) (string, []string, error) {
+	doc, _ := html.Parse(strings.NewReader(content))
+
+	blobIDs := []string{}
+	var crawlNode func(*html.Node)
+	crawlNode = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.Data == "img" {
+			blobID := getAttribute(node, "az-blob-id")
+			if blobID != "" {
+				removeAttribute(node, "az-blob-id")
+				removeAttribute(node, "src")
+				node.Attr = append(node.Attr, html.Attribute{Key: "src", Val: path.Join(dir, blobID)})
+				blobIDs = append(blobIDs, blobID)
+			}
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			crawlNode(child)
+		}
+	}
+	crawlNode(doc)
+
+	fragment, err := renderBody(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	return fragment, blobIDs, nil
+}
+
+// DownloadMedia opens the blob used by a card of the deck, the boolean is false if the
+// blob does not exist or cannot be used by the deck, so that the exports skip it
+func DownloadMedia(db *mongo.Database, blobStorage storage.BlobStorage, deck mongo.Deck, blobID string) (io.ReadCloser, bool, error) {
+	allowed, err := CanDeckUseMedia(db, deck, blobID)
+	if err != nil || !allowed {
+		return nil, false, err
+	}
+
+	exists, err := blobStorage.Exists(blobID)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	reader, err := blobStorage.Download(blobID, 0, 0)
+	return reader, true, err
+}
+
+// StripHTML returns the text of the HTML content, without the tags and with the entities decoded
+func StripHTML(content string) string {
+	doc, _ := html.Parse(strings.NewReader(content))
+
+	var text strings.Builder
+	var crawlNode func(*html.Node)
+	crawlNode = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			text.WriteString(node.Data)
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			crawlNode(child)
+		}
+	}
+	crawlNode(doc)
+
+	return text.String()
+}
+
+// HTMLFragment returns the content of the body of the HTML document,
+// without the html, head and body tags added when the cards are saved
+func HTMLFragment(content string) (string, error) {
+	doc, _ := html.Parse(strings.NewReader(content))
+	return renderBody(doc)
+}
+
+// renderBody renders the children of the body element of the document
+func renderBody(doc *html.Node) (string, error) {
+	body := findElement(doc, "body")
+	if body == nil {
+		body = doc
+	}
+
+	var b strings.Builder
+	for child := body.FirstChild; child != nil; child = child.NextSibling {
+		if err := html.Render(&b, child); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// findElement returns the first element with the given tag in the tree, or nil
+func findElement(node *html.Node, tag string) *html.Node {
+	if node.Type == html.ElementNode && node.Data == tag {
+		return node
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, tag); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// getAttribute returns the value of the attribute with the given key, or an empty string
+func getAttribute(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
+
+// removeAttribute removes all the attributes with the given key from the node
+func removeAttribute(node *html.Node, key string) {
+	attrs := node.Attr[:0]
+	for _, attr := range node.Attr {
+		if attr.Key != key {
+			attrs = append(attrs, attr)
+		}
+	}
+	node.Attr = attrs
+}
+
 // ListImageIDs returns a list of image IDs from the given HTML content
 func ListImageIDs(content string) []string {
 	doc, _ := html.Parse(strings.NewReader(content))
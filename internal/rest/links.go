@@ -0,0 +1,207 @@
+package rest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewShareLinkToken returns a random URL-safe token and the hash that is stored
+func NewShareLinkToken() (string, string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashShareLinkToken(token), nil
+}
+
+// HashShareLinkToken returns the hex encoded SHA-256 hash of the token
+func HashShareLinkToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// SharedCard is the read-only representation of a card returned by share links
+type SharedCard struct {
+	ID    string   `json:"id"`
+	Front string   `json:"front"`
+	Back  string   `json:"back"`
+	Tags  []string `json:"tags"`
+}
+
+func setupShareLinkRoutes(r *gin.Engine, db *mongo.Database, storage storage.BlobStorage) {
+	r.GET("/decks/:deckId/links", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		links := []*mongo.ShareLink{}
+		err := db.ShareLinks.FindAll(bson.M{
+			"deck": deck.ID,
+		}, &links)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the share links")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, links)
+	})
+
+	r.POST("/decks/:deckId/links", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		var payload struct {
+			ExpiresAt *time.Time `json:"expiresAt"`
+		}
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid payload")
+			return
+		} else if payload.ExpiresAt != nil && payload.ExpiresAt.Before(time.Now()) {
+			c.String(http.StatusBadRequest, "The `expiresAt` field must be in the future")
+			return
+		}
+
+		// The token is returned only once, since just its hash is stored
+		token, tokenHash, err := NewShareLinkToken()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to generate the token")
+			restLogger.Error(err)
+			return
+		}
+
+		linkId, err := db.ShareLinks.InsertOne(&mongo.ShareLink{
+			TokenHash: tokenHash,
+			Deck:      deck.ID,
+			ExpiresAt: payload.ExpiresAt,
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the share link")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, map[string]string{
+			"id":    linkId.Hex(),
+			"token": token,
+			"path":  "/shared/" + token,
+		})
+	})
+
+	r.DELETE("/decks/:deckId/links/:linkId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		linkId, err := primitive.ObjectIDFromHex(c.Param("linkId"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid link id")
+			return
+		}
+
+		deleted, err := db.ShareLinks.DeleteMany(bson.M{
+			"_id":  linkId,
+			"deck": deck.ID,
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to revoke the share link")
+			restLogger.Error(err)
+			return
+		} else if deleted == 0 {
+			c.String(http.StatusBadRequest, "The specified share link does not exist")
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	// The token in the path authorizes the request, so no authentication is needed
+	r.GET("/shared/:token", func(c *gin.Context) {
+		var link mongo.ShareLink
+		exists, err := db.ShareLinks.FindOneIfExists(bson.M{
+			"tokenHash": HashShareLinkToken(c.Param("token")),
+		}, &link)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the share link")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusNotFound, "The share link does not exist or has been revoked")
+			return
+		} else if link.ExpiresAt != nil && link.ExpiresAt.Before(time.Now()) {
+			c.String(http.StatusGone, "The share link has expired")
+			return
+		}
+
+		var deck mongo.Deck
+		exists, err = db.Decks.FindByIdIfExists(link.Deck, &deck)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusNotFound, "The share link does not exist or has been revoked")
+			return
+		}
+
+		// Load the cards of the deck and of its sub-decks
+		descendants, err := DescendantDeckIds(db, deck.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the sub-decks")
+			restLogger.Error(err)
+			return
+		}
+		cards, err := LoadCards(db, append([]primitive.ObjectID{deck.ID}, descendants...))
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		// Only the content is shared, with the image references replaced by signed links
+		sharedCards := make([]SharedCard, len(cards))
+		for i := range cards {
+			err = SignCardImages(&cards[i], storage)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to sign the image links")
+				restLogger.Error(err)
+				return
+			}
+
+			sharedCards[i] = SharedCard{
+				ID:    cards[i].ID,
+				Front: cards[i].Front,
+				Back:  cards[i].Back,
+				Tags:  cards[i].Tags,
+			}
+		}
+
+		// Count the view
+		_, err = db.ShareLinks.UpdateById(link.ID, mongo.UpdateDocument{
+			op.Inc: bson.M{
+				"views": 1,
+			},
+			op.Set: bson.M{
+				"lastViewedAt": time.Now(),
+			},
+		})
+		if err != nil {
+			restLogger.Error(err)
+		}
+
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"name":  deck.Name,
+			"cards": sharedCards,
+		})
+	})
+}
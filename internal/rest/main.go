@@ -11,10 +11,22 @@ import (
 
 var restLogger = log.Default().Service("rest")
 
-func SetupRoutes(r *gin.Engine, db *mongo.Database, storage *storage.BlobStorage) {
+func SetupRoutes(r *gin.Engine, db *mongo.Database, storage storage.BlobStorage) {
 	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
 	r.Use(ParseAuthorizationHeader(jwtSecret))
-	setupUserRoutes(r, db, jwtSecret)
-	setupDeckRoutes(r, db)
+	setupUserRoutes(r, db, jwtSecret, storage)
+	setupDeckRoutes(r, db, storage)
 	setupCardRoutes(r, db, storage)
+	setupMediaRoutes(r, db, storage)
+	setupSharingRoutes(r, db)
+	setupCatalogRoutes(r, db)
+	setupShareLinkRoutes(r, db, storage)
+	setupAnkiRoutes(r, db, storage)
+	setupCSVRoutes(r, db, storage)
+	setupTextRoutes(r, db, storage)
+	setupDataExportRoutes(r, db, storage)
+	setupPDFRoutes(r, db, storage)
+	setupSnapshotRoutes(r, db, storage)
+	setupTrashRoutes(r, db, storage)
+	setupVacationRoutes(r, db)
 }
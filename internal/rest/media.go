@@ -0,0 +1,175 @@
+package rest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// MaxMediaSize is the maximum size in bytes of a request uploading a media file
+const MaxMediaSize = 10 * 1024 * 1024
+
+// mediaExtensions maps the sniffed MIME types that can be uploaded
+// to the extension used in the blob name
+var mediaExtensions = map[string]string{
+	"image/png":       "png",
+	"image/jpeg":      "jpeg",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"image/bmp":       "bmp",
+	"audio/mpeg":      "mp3",
+	"audio/wave":      "wav",
+	"application/ogg": "ogg",
+}
+
+// mediaContentType returns the MIME type of a blob based on its extension
+func mediaContentType(filename string) string {
+	extension := path.Ext(filename)
+	for contentType, ext := range mediaExtensions {
+		if "."+ext == extension {
+			return contentType
+		}
+	}
+
+	return "application/octet-stream"
+}
+
+func setupMediaRoutes(r *gin.Engine, db *mongo.Database, blobStorage storage.BlobStorage) {
+	r.POST("/media", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		// Find the file in the multipart body without buffering it
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxMediaSize)
+		reader, err := c.Request.MultipartReader()
+		if err != nil {
+			c.String(http.StatusBadRequest, "The payload must be a multipart form")
+			return
+		}
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				c.String(http.StatusBadRequest, "You must specify a `file` field")
+				return
+			} else if err != nil {
+				c.String(http.StatusBadRequest, "Invalid multipart payload")
+				return
+			}
+			if part.FormName() != "file" {
+				continue
+			}
+
+			// Detect the file type from its content
+			head := make([]byte, 512)
+			n, err := io.ReadFull(part, head)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				c.String(http.StatusBadRequest, "Failed to read the file")
+				return
+			}
+			head = head[:n]
+
+			extension, ok := mediaExtensions[http.DetectContentType(head)]
+			if !ok {
+				c.String(http.StatusUnsupportedMediaType, "The file type is not supported")
+				return
+			}
+
+			// Stream the file to the storage
+			ID := uuid.NewString() + "." + extension
+			err = UserStorage(db, blobStorage, user).Upload(ID, io.MultiReader(bytes.NewReader(head), part))
+			if err != nil {
+				// Remove any partially uploaded content
+				_ = blobStorage.Delete(ID)
+
+				var maxBytesErr *http.MaxBytesError
+				if errors.Is(err, ErrStorageQuotaExceeded) {
+					c.String(http.StatusForbidden, "The file exceeds the storage quota of your plan")
+					return
+				} else if errors.As(err, &maxBytesErr) {
+					c.String(http.StatusRequestEntityTooLarge, "The file is too large")
+					return
+				}
+
+				c.String(http.StatusInternalServerError, "Failed to upload the file")
+				restLogger.Error(err)
+				return
+			}
+
+			url, err := blobStorage.SignedURL(ID, SignedURLValidity)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to sign the file link")
+				restLogger.Error(err)
+				return
+			}
+
+			c.JSON(http.StatusOK, map[string]interface{}{
+				"id":  ID,
+				"url": url,
+			})
+			return
+		}
+	})
+	r.GET("/media/:blobId", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		// Check that the user can see the blob
+		blobId := c.Param("blobId")
+		allowed, err := CanAccessMedia(db, user, blobId)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the file")
+			restLogger.Error(err)
+			return
+		} else if !allowed {
+			c.String(http.StatusNotFound, "The specified file does not exist")
+			return
+		}
+
+		properties, err := blobStorage.Properties(blobId)
+		if errors.Is(err, storage.ErrBlobNotFound) {
+			c.String(http.StatusNotFound, "The specified file does not exist")
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the file")
+			restLogger.Error(err)
+			return
+		}
+
+		// The blob names are never reused, so the content can be cached indefinitely
+		c.Header("Content-Type", mediaContentType(blobId))
+		c.Header("Cache-Control", "private, max-age=31536000, immutable")
+		c.Header("X-Content-Type-Options", "nosniff")
+		if properties.ETag != "" {
+			c.Header("ETag", properties.ETag)
+		}
+
+		// ServeContent handles the conditional and range requests
+		content := storage.NewBlobReader(blobStorage, blobId, properties.Size)
+		defer content.Close()
+		http.ServeContent(c.Writer, c.Request, blobId, properties.LastModified, content)
+	})
+}
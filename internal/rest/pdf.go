@@ -0,0 +1,200 @@
+package rest
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/printable"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/html"
+)
+
+// printableImageTypes maps the extensions of the blobs to the image formats supported in PDFs
+var printableImageTypes = map[string]string{
+	".png":  printable.PNG,
+	".jpg":  printable.JPG,
+	".jpeg": printable.JPG,
+	".gif":  printable.GIF,
+}
+
+// blockElements are the elements whose content starts on a new line
+var blockElements = []string{"p", "div", "br", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre"}
+
+var whitespaceRegex = regexp.MustCompile(`[ \t\r\n]+`)
+
+// MaxPrintableImageSize is the maximum size in bytes of an image included in a
+// PDF, the larger ones are left out
+const MaxPrintableImageSize = 10 * 1024 * 1024
+
+// MaxPrintableImagesSize is the maximum total size in bytes of the images of a
+// PDF, since the document is built in memory; the images exceeding it are left out
+const MaxPrintableImagesSize = 200 * 1024 * 1024
+
+// printableImages caches the images of a PDF by blob ID, a nil image is one left out
+type printableImages struct {
+	images map[string]*printable.Image
+	size   int64
+}
+
+// printableSide extracts the text and the images of the HTML content of a card side of
+// the deck, the images are downloaded from the storage and cached by blob ID
+func printableSide(db *mongo.Database, blobStorage storage.BlobStorage, deck mongo.Deck, content string, images *printableImages) (printable.Side, error) {
+	doc, _ := html.Parse(strings.NewReader(content))
+
+	var text strings.Builder
+	side := printable.Side{}
+	var crawlNode func(*html.Node) error
+	crawlNode = func(node *html.Node) error {
+		switch {
+		case node.Type == html.TextNode:
+			text.WriteString(whitespaceRegex.ReplaceAllString(node.Data, " "))
+		case node.Type == html.ElementNode && node.Data == "img":
+			blobID := getAttribute(node, "az-blob-id")
+			imageType, ok := printableImageTypes[strings.ToLower(path.Ext(blobID))]
+			if blobID == "" || !ok {
+				return nil
+			}
+
+			image, ok := images.images[blobID]
+			if !ok {
+				reader, exists, err := DownloadMedia(db, blobStorage, deck, blobID)
+				if err != nil {
+					return err
+				} else if !exists {
+					images.images[blobID] = nil
+					return nil
+				}
+				data, err := io.ReadAll(io.LimitReader(reader, MaxPrintableImageSize+1))
+				reader.Close()
+				if err != nil {
+					return err
+				}
+
+				size := int64(len(data))
+				if size > MaxPrintableImageSize || images.size+size > MaxPrintableImagesSize {
+					images.images[blobID] = nil
+					return nil
+				}
+				image = &printable.Image{Name: blobID, Type: imageType, Data: data}
+				images.images[blobID] = image
+				images.size += size
+			}
+			if image != nil {
+				side.Images = append(side.Images, *image)
+			}
+			return nil
+		case node.Type == html.ElementNode && node.Data == "li":
+			text.WriteString("\n• ")
+		case node.Type == html.ElementNode && slices.Contains(blockElements, node.Data):
+			text.WriteString("\n")
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if err := crawlNode(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := crawlNode(doc); err != nil {
+		return side, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(text.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	side.Text = strings.Join(lines, "\n")
+
+	return side, nil
+}
+
+func setupPDFRoutes(r *gin.Engine, db *mongo.Database, blobStorage storage.BlobStorage) {
+	r.GET("/decks/:deckId/export.pdf", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// Parse the layout options
+		options := printable.Options{
+			Title:    deck.Name,
+			PageSize: c.Query("pageSize"),
+		}
+		for name, value := range map[string]*int{"columns": &options.Columns, "rows": &options.Rows} {
+			if raw := c.Query(name); raw != "" {
+				parsed, err := strconv.Atoi(raw)
+				if err != nil {
+					c.String(http.StatusBadRequest, "The `%s` parameter must be an integer", name)
+					return
+				}
+				*value = parsed
+			}
+		}
+		if err := options.Validate(); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		layout := c.DefaultQuery("layout", "grid")
+		if layout != "grid" && layout != "list" {
+			c.String(http.StatusBadRequest, "The `layout` parameter must be grid or list")
+			return
+		}
+
+		cards, err := LoadCards(db, []primitive.ObjectID{deck.ID})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		images := &printableImages{images: map[string]*printable.Image{}}
+		printableCards := make([]printable.Card, len(cards))
+		for i, card := range cards {
+			front, err := printableSide(db, blobStorage, deck, card.Front, images)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the images")
+				restLogger.Error(err)
+				return
+			}
+			back, err := printableSide(db, blobStorage, deck, card.Back, images)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the images")
+				restLogger.Error(err)
+				return
+			}
+
+			printableCards[i] = printable.Card{Front: front, Back: back}
+		}
+
+		// Write the PDF to a temporary file, so that failures can still be reported
+		tmp, err := os.CreateTemp("", "binder-pdf-*.pdf")
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the PDF")
+			restLogger.Error(err)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		if layout == "list" {
+			err = printable.WriteList(tmp, printableCards, options)
+		} else {
+			err = printable.WriteGrid(tmp, printableCards, options)
+		}
+		tmp.Close()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the PDF")
+			restLogger.Error(err)
+			return
+		}
+
+		c.FileAttachment(tmp.Name(), exportFilename(deck.Name)+".pdf")
+	})
+}
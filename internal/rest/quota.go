@@ -0,0 +1,293 @@
+package rest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+var ErrStorageQuotaExceeded error = fmt.Errorf("the storage quota of the plan is exceeded")
+
+// quotaReader counts the bytes read from the wrapped reader and fails
+// as soon as they exceed the remaining quota
+type quotaReader struct {
+	reader    io.Reader
+	remaining int64
+	read      int64
+	exceeded  bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.remaining {
+		r.exceeded = true
+		return n, ErrStorageQuotaExceeded
+	}
+
+	return n, err
+}
+
+// userStorage wraps a blob storage to account the uploaded blobs to the
+// storage usage of a user, rejecting the uploads that exceed the quota
+// of the user's plan
+type userStorage struct {
+	storage.BlobStorage
+	db   *mongo.Database
+	user mongo.User
+}
+
+// UserStorage returns a blob storage that tracks the bytes uploaded by the user
+func UserStorage(db *mongo.Database, blobStorage storage.BlobStorage, user mongo.User) storage.BlobStorage {
+	return &userStorage{
+		BlobStorage: blobStorage,
+		db:          db,
+		user:        user,
+	}
+}
+
+func (s *userStorage) Upload(filename string, content io.Reader) error {
+	// Load the current usage, since it may have changed after the user was loaded
+	var user mongo.User
+	err := s.db.Users.FindById(s.user.ID, &user)
+	if err != nil {
+		return err
+	}
+
+	quota := user.Plan.StorageQuota()
+	if user.StorageUsage >= quota {
+		return ErrStorageQuotaExceeded
+	}
+
+	reader := &quotaReader{
+		reader:    content,
+		remaining: quota - user.StorageUsage,
+	}
+	err = s.BlobStorage.Upload(filename, reader)
+	if reader.exceeded {
+		_ = s.BlobStorage.Delete(filename)
+		return ErrStorageQuotaExceeded
+	} else if err != nil {
+		return err
+	}
+
+	// Increment the usage only if the quota is still respected, since other
+	// uploads may have completed in the meantime
+	res, err := s.db.Users.UpdateOne(bson.M{
+		"_id": user.ID,
+		string(op.Or): []bson.M{
+			{"storageUsage": bson.M{string(op.Exists): false}},
+			{"storageUsage": bson.M{string(op.Lte): quota - reader.read}},
+		},
+	}, mongo.UpdateDocument{
+		op.Inc: bson.M{
+			"storageUsage": reader.read,
+		},
+	})
+	if err != nil {
+		_ = s.BlobStorage.Delete(filename)
+		return err
+	} else if res.MatchedCount == 0 {
+		_ = s.BlobStorage.Delete(filename)
+		return ErrStorageQuotaExceeded
+	}
+
+	_, err = s.db.Blobs.InsertOne(&mongo.Blob{
+		Name:  filename,
+		Owner: user.ID,
+		Size:  reader.read,
+	})
+	if err != nil {
+		// Without the record the usage could never be released
+		_ = s.BlobStorage.Delete(filename)
+		_, rollbackErr := s.db.Users.UpdateById(user.ID, mongo.UpdateDocument{
+			op.Inc: bson.M{
+				"storageUsage": -reader.read,
+			},
+		})
+		if rollbackErr != nil {
+			restLogger.Error(rollbackErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *userStorage) Delete(filename string) error {
+	return DeleteMedia(s.db, s.BlobStorage, filename)
+}
+
+// DeleteMedia deletes the blob from the storage and releases
+// its size from the storage usage of its owner
+func DeleteMedia(db *mongo.Database, blobStorage storage.BlobStorage, filename string) error {
+	err := blobStorage.Delete(filename)
+	if err != nil {
+		return err
+	}
+
+	// Blobs uploaded before the usage was tracked have no record
+	var blob mongo.Blob
+	exists, err := db.Blobs.FindOneIfExists(bson.M{
+		"name": filename,
+	}, &blob)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = db.Users.UpdateById(blob.Owner, mongo.UpdateDocument{
+		op.Inc: bson.M{
+			"storageUsage": -blob.Size,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Blobs.DeleteById(blob.ID)
+	return err
+}
+
+// mediaReferenceFilter matches the cards that use the blob, prefix is
+// prepended to the field names to match the cards embedded in other documents
+func mediaReferenceFilter(filename string, prefix string) bson.M {
+	return bson.M{
+		prefix + "media": filename,
+	}
+}
+
+// IsMediaReferenced checks whether any card, trashed card or deck snapshot still contains the blob
+func IsMediaReferenced(db *mongo.Database, filename string) (bool, error) {
+	referenced, err := db.Cards.Exists(mediaReferenceFilter(filename, ""))
+	if err != nil || referenced {
+		return referenced, err
+	}
+
+	referenced, err = db.Trash.Exists(mediaReferenceFilter(filename, "card."))
+	if err != nil || referenced {
+		return referenced, err
+	}
+
+	return db.DeckSnapshots.Exists(bson.M{
+		"media": filename,
+	})
+}
+
+// isBlobName checks that the blob ID referenced by a card can be used as a
+// filename, since the exports write the blobs in archives named by their ID
+func isBlobName(filename string) bool {
+	return filename != "" && !strings.HasPrefix(filename, ".") && !strings.ContainsAny(filename, "/\\")
+}
+
+// CanDeckUseMedia checks whether the blob can be served as part of the deck, i.e.
+// whether it was uploaded by a user that can edit the deck. Otherwise anyone could
+// reference the images of other users in their cards and then download them
+func CanDeckUseMedia(db *mongo.Database, deck mongo.Deck, filename string) (bool, error) {
+	if !isBlobName(filename) {
+		return false, nil
+	}
+
+	var blob mongo.Blob
+	exists, err := db.Blobs.FindOneIfExists(bson.M{
+		"name": filename,
+	}, &blob)
+	if err != nil {
+		return false, err
+	} else if !exists {
+		// The blobs uploaded before the usage was tracked have no record, the
+		// data exports have none either but are never part of a deck
+		isExport, err := db.DataExports.Exists(bson.M{
+			"blobId": filename,
+		})
+		return !isExport, err
+	}
+
+	role, err := DeckRoleOf(db, deck, blob.Owner)
+	if err != nil {
+		return false, err
+	}
+
+	return role.Includes(mongo.EditorRole), nil
+}
+
+// CanAccessMedia checks whether the user uploaded the blob or can
+// access a deck that uses it, either owned or shared with them
+func CanAccessMedia(db *mongo.Database, user mongo.User, filename string) (bool, error) {
+	uploaded, err := db.Blobs.Exists(bson.M{
+		"name":  filename,
+		"owner": user.ID,
+	})
+	if err != nil || uploaded {
+		return uploaded, err
+	}
+
+	deckIds, err := AccessibleDeckIds(db, user.ID)
+	if err != nil || len(deckIds) == 0 {
+		return false, err
+	}
+
+	filter := mediaReferenceFilter(filename, "")
+	filter["deckId"] = bson.M{string(op.In): deckIds}
+	cards := []*mongo.Card{}
+	err = db.Cards.Aggregate(bson.A{
+		bson.M{string(op.Match): filter},
+		bson.M{string(op.Project): bson.M{"deckId": 1}},
+	}, &cards)
+	if err != nil {
+		return false, err
+	}
+
+	checked := []primitive.ObjectID{}
+	for _, card := range cards {
+		if slices.Contains(checked, card.DeckID) {
+			continue
+		}
+		checked = append(checked, card.DeckID)
+
+		var deck mongo.Deck
+		exists, err := db.Decks.FindByIdIfExists(card.DeckID, &deck)
+		if err != nil {
+			return false, err
+		} else if !exists {
+			continue
+		}
+
+		allowed, err := CanDeckUseMedia(db, deck, filename)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+
+	return false, nil
+}
+
+// ReleaseUnusedMedia deletes the blobs that are no longer referenced
+// by any card, errors are logged since the cards were already updated
+func ReleaseUnusedMedia(db *mongo.Database, blobStorage storage.BlobStorage, filenames []string) {
+	for _, filename := range filenames {
+		referenced, err := IsMediaReferenced(db, filename)
+		if err != nil {
+			restLogger.Error(err)
+			continue
+		} else if referenced {
+			continue
+		}
+
+		err = DeleteMedia(db, blobStorage, filename)
+		if err != nil {
+			restLogger.Error(err)
+		}
+	}
+}
+
+// CardMedia returns the IDs of the blobs referenced by the card
+func CardMedia(card mongo.Card) []string {
+	return append(ListImageIDs(card.Front), ListImageIDs(card.Back)...)
+}
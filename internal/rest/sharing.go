@@ -0,0 +1,440 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+)
+
+// DeckRoleOf returns the role of the user on the deck, a deck shared
+// with a collaborator or published also shares all its sub-decks
+func DeckRoleOf(db *mongo.Database, deck mongo.Deck, userId primitive.ObjectID) (mongo.DeckRole, error) {
+	if deck.Owner == userId {
+		return mongo.OwnerRole, nil
+	}
+
+	// Walk up the ancestors looking for the highest role granted to the user
+	role := mongo.NoRole
+	visited := []primitive.ObjectID{}
+	for {
+		for _, collaborator := range deck.Collaborators {
+			if collaborator.User == userId && !role.Includes(collaborator.Role) {
+				role = collaborator.Role
+			}
+		}
+		if deck.Published && !role.Includes(mongo.PublicRole) {
+			role = mongo.PublicRole
+		}
+
+		if deck.Parent == nil || slices.Contains(visited, deck.ID) {
+			return role, nil
+		}
+		visited = append(visited, deck.ID)
+
+		err := db.Decks.FindById(*deck.Parent, &deck)
+		if err == mongo.ErrNoDocuments {
+			return role, nil
+		} else if err != nil {
+			return mongo.NoRole, err
+		}
+	}
+}
+
+// DeckAuthorized returns a Gin handler function that loads the deck specified
+// by the "deckId" route parameter and checks that the authenticated user has
+// at least the passed role on it. The user and the deck are stored in the
+// "user" and "deck" context fields. The middleware expects the token to have
+// already been checked by the Authenticated(...) middleware
+func DeckAuthorized(db *mongo.Database, minimumRole mongo.DeckRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			c.Abort()
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			c.Abort()
+			return
+		}
+
+		// Load deck
+		rawId := c.Param("deckId")
+		deckId, err := primitive.ObjectIDFromHex(rawId)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid deck id")
+			c.Abort()
+			return
+		}
+
+		var deck mongo.Deck
+		exists, err = db.Decks.FindByIdIfExists(deckId, &deck)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			restLogger.Error(err)
+			c.Abort()
+			return
+		} else if !exists {
+			c.String(http.StatusBadRequest, "The specified deck does not exist")
+			c.Abort()
+			return
+		}
+
+		// Check the role of the user
+		role, err := DeckRoleOf(db, deck, user.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the deck")
+			restLogger.Error(err)
+			c.Abort()
+			return
+		} else if role == mongo.NoRole {
+			c.String(http.StatusUnauthorized, "This deck has not been shared with you")
+			c.Abort()
+			return
+		} else if !role.Includes(minimumRole) {
+			c.String(http.StatusUnauthorized, "You need the %s role on this deck", minimumRole)
+			c.Abort()
+			return
+		}
+		deck.Role = role
+
+		c.Set("user", user)
+		c.Set("deck", deck)
+	}
+}
+
+// CanStudyDeck checks whether the user can study the deck, the published decks
+// can only be studied after subscribing to them or to one of their ancestors
+func CanStudyDeck(db *mongo.Database, deck mongo.Deck, role mongo.DeckRole, userId primitive.ObjectID) (bool, error) {
+	if role.Includes(mongo.ViewerRole) {
+		return true, nil
+	} else if role == mongo.NoRole {
+		return false, nil
+	}
+
+	deckIds := []primitive.ObjectID{deck.ID}
+	for deck.Parent != nil && !slices.Contains(deckIds, *deck.Parent) {
+		deckIds = append(deckIds, *deck.Parent)
+
+		err := db.Decks.FindById(*deck.Parent, &deck)
+		if err == mongo.ErrNoDocuments {
+			break
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return db.Subscriptions.Exists(bson.M{
+		"user": userId,
+		"deck": bson.M{string(op.In): deckIds},
+	})
+}
+
+// StudyAuthorized returns a Gin handler function that checks that the user
+// can study the deck loaded by the DeckAuthorized(...) middleware
+func StudyAuthorized(db *mongo.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		allowed, err := CanStudyDeck(db, deck, deck.Role, user.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the subscriptions")
+			restLogger.Error(err)
+			c.Abort()
+			return
+		} else if !allowed {
+			c.String(http.StatusForbidden, "You need to subscribe to this deck to study it")
+			c.Abort()
+			return
+		}
+	}
+}
+
+// AccessibleDeckIds returns the IDs of the decks owned by the user, shared
+// with them or subscribed, including the sub-decks of the non-owned ones
+func AccessibleDeckIds(db *mongo.Database, userId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	subscribedIds, err := SubscribedDeckIds(db, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	decks := []*mongo.Deck{}
+	err = db.Decks.FindAll(UserDecksFilter(userId, subscribedIds), &decks)
+	if err != nil {
+		return nil, err
+	}
+
+	deckIds := []primitive.ObjectID{}
+	sharedIds := []primitive.ObjectID{}
+	for _, deck := range decks {
+		deckIds = append(deckIds, deck.ID)
+		if deck.Owner != userId {
+			sharedIds = append(sharedIds, deck.ID)
+		}
+	}
+
+	for _, sharedId := range sharedIds {
+		descendants, err := DescendantDeckIds(db, sharedId)
+		if err != nil {
+			return nil, err
+		}
+		for _, descendant := range descendants {
+			if !slices.Contains(deckIds, descendant) {
+				deckIds = append(deckIds, descendant)
+			}
+		}
+	}
+
+	return deckIds, nil
+}
+
+// UserDecksFilter matches the decks owned by the user, the ones shared
+// with them and the subscribed ones that are still published
+func UserDecksFilter(userId primitive.ObjectID, subscribedIds []primitive.ObjectID) bson.M {
+	if subscribedIds == nil {
+		subscribedIds = []primitive.ObjectID{}
+	}
+
+	return bson.M{
+		string(op.Or): bson.A{
+			bson.M{"owner": userId},
+			bson.M{"collaborators.user": userId},
+			bson.M{
+				"_id":       bson.M{string(op.In): subscribedIds},
+				"published": true,
+			},
+		},
+	}
+}
+
+// VisibleDeck hides the details that only the owner and the
+// collaborators of a deck should see from the deck returned to the user
+func VisibleDeck(deck *mongo.Deck) {
+	if !deck.Role.Includes(mongo.ViewerRole) {
+		deck.Collaborators = nil
+	}
+}
+
+// SchedulingUser returns the value of the userId field of the repetitions
+// made by the user on the deck's cards: the repetitions of the owner have
+// no userId since the owner's scheduling state is stored in the cards
+func SchedulingUser(deck mongo.Deck, userId primitive.ObjectID) *primitive.ObjectID {
+	if deck.Owner == userId {
+		return nil
+	}
+
+	return &userId
+}
+
+// ApplyCardSchedules replaces the scheduling state of the cards of a deck
+// owned by someone else with the user's own scheduling state, the cards
+// the user has never studied are returned as new cards
+func ApplyCardSchedules(db *mongo.Database, deck mongo.Deck, userId primitive.ObjectID, cards []mongo.Card) error {
+	if deck.Owner == userId || len(cards) == 0 {
+		return nil
+	}
+
+	deckIds := []primitive.ObjectID{}
+	for _, card := range cards {
+		if !slices.Contains(deckIds, card.DeckID) {
+			deckIds = append(deckIds, card.DeckID)
+		}
+	}
+
+	schedules := []*mongo.CardSchedule{}
+	err := db.Schedules.FindAll(bson.M{
+		"userId": userId,
+		"deckId": bson.M{string(op.In): deckIds},
+	}, &schedules)
+	if err != nil {
+		return err
+	}
+
+	schedulesByCard := map[primitive.ObjectID]map[string]*mongo.CardSchedule{}
+	for _, schedule := range schedules {
+		if schedulesByCard[schedule.DeckID] == nil {
+			schedulesByCard[schedule.DeckID] = map[string]*mongo.CardSchedule{}
+		}
+		schedulesByCard[schedule.DeckID][schedule.CardId] = schedule
+	}
+
+	for i := range cards {
+		card := &cards[i]
+		schedule, ok := schedulesByCard[card.DeckID][card.ID]
+		if !ok {
+			card.Factor = 2.5
+			card.HalfLife = 0
+			card.TotalRepetitions = 0
+			card.CorrectRepetitions = 0
+			card.LastRepetition = nil
+			card.DueAt = nil
+			continue
+		}
+
+		card.Factor = schedule.Factor
+		card.HalfLife = schedule.HalfLife
+		card.TotalRepetitions = schedule.TotalRepetitions
+		card.CorrectRepetitions = schedule.CorrectRepetitions
+		card.LastRepetition = schedule.LastRepetition
+		card.DueAt = schedule.DueAt
+	}
+
+	return nil
+}
+
+// SaveCardSchedule stores the scheduling state computed by processRepetitions
+// in the card for the deck's owner and in the schedules collection for the
+// collaborators
+func SaveCardSchedule(db *mongo.Database, card mongo.Card, schedulingUser *primitive.ObjectID, update bson.M) error {
+	if schedulingUser == nil {
+		_, err := db.Cards.UpdateById(card.BasicModel.ID, mongo.UpdateDocument{
+			op.Set: update,
+		})
+		return err
+	}
+
+	_, err := db.Schedules.UpdateOne(bson.M{
+		"userId": *schedulingUser,
+		"deckId": card.DeckID,
+		"cardId": card.ID,
+	}, mongo.UpdateDocument{
+		op.Set: update,
+		op.SetOnInsert: bson.M{
+			"createdAt": time.Now(),
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func setupSharingRoutes(r *gin.Engine, db *mongo.Database) {
+	r.GET("/decks/:deckId/collaborators", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.ViewerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		collaborators := deck.Collaborators
+		if collaborators == nil {
+			collaborators = []mongo.Collaborator{}
+		}
+
+		c.JSON(http.StatusOK, collaborators)
+	})
+
+	r.PUT("/decks/:deckId/collaborators", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// Parse payload
+		var payload struct {
+			Email string         `json:"email"`
+			Role  mongo.DeckRole `json:"role"`
+		}
+		err := c.ShouldBindJSON(&payload)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid payload")
+			return
+		} else if payload.Email == "" {
+			c.String(http.StatusBadRequest, "You must specify a non-empty `email` field")
+			return
+		} else if !payload.Role.Valid() {
+			c.String(http.StatusBadRequest, "The `role` field must be one of `viewer`, `editor` and `owner`")
+			return
+		}
+
+		// Load the collaborator
+		var collaborator mongo.User
+		exists, err := db.Users.FindOneIfExists(bson.M{
+			"email": payload.Email,
+		}, &collaborator)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusBadRequest, "No user with this email exists")
+			return
+		} else if collaborator.ID == deck.Owner {
+			c.String(http.StatusBadRequest, "The deck cannot be shared with its owner")
+			return
+		}
+
+		// Update the role of an existing collaborator or add a new one
+		_, err = db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				_, err := db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
+					op.Pull: bson.M{
+						"collaborators": bson.M{"user": collaborator.ID},
+					},
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				_, err = db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
+					op.Push: bson.M{
+						"collaborators": mongo.Collaborator{
+							User:  collaborator.ID,
+							Email: collaborator.Email,
+							Role:  payload.Role,
+						},
+					},
+				})
+				return nil, err
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to share the deck")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, collaborator.ID.Hex())
+	})
+
+	r.DELETE("/decks/:deckId/collaborators/:userId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.ViewerRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		collaboratorId, err := primitive.ObjectIDFromHex(c.Param("userId"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid user id")
+			return
+		}
+
+		// Collaborators can leave the deck, only owners can remove others
+		if collaboratorId != user.ID && !deck.Role.Includes(mongo.OwnerRole) {
+			c.String(http.StatusUnauthorized, "You need the %s role on this deck", mongo.OwnerRole)
+			return
+		}
+
+		isCollaborator := slices.ContainsFunc(deck.Collaborators, func(collaborator mongo.Collaborator) bool {
+			return collaborator.User == collaboratorId
+		})
+		if !isCollaborator {
+			c.String(http.StatusBadRequest, "The specified user is not a collaborator of this deck")
+			return
+		}
+
+		// The scheduling state is kept in case the deck is shared again
+		_, err = db.Decks.UpdateById(deck.ID, mongo.UpdateDocument{
+			op.Pull: bson.M{
+				"collaborators": bson.M{"user": collaboratorId},
+			},
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to update the collaborators")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+}
@@ -0,0 +1,386 @@
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// MaxDeckSnapshots is the maximum number of snapshots kept for each deck
+const MaxDeckSnapshots = 20
+
+// MaxSnapshotSize is the maximum size in bytes of the compressed content of a
+// snapshot, so that the snapshot fits in a single document
+const MaxSnapshotSize = 15 * 1024 * 1024
+
+var ErrSnapshotTooLarge error = fmt.Errorf("the deck is too large to be snapshotted")
+
+// encodeSnapshot compresses the BSON encoding of the snapshot content
+func encodeSnapshot(content mongo.SnapshotContent) ([]byte, error) {
+	raw, err := bson.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err = writer.Write(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decodeSnapshot returns the content of the snapshot
+func decodeSnapshot(snapshot mongo.DeckSnapshot) (mongo.SnapshotContent, error) {
+	var content mongo.SnapshotContent
+	reader, err := gzip.NewReader(bytes.NewReader(snapshot.Content))
+	if err != nil {
+		return content, err
+	}
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return content, err
+	}
+
+	err = bson.Unmarshal(raw, &content)
+	return content, err
+}
+
+// CreateDeckSnapshot stores a snapshot with the cards of the deck and the
+// repetitions of its owner, whose scheduling state is stored in the cards
+func CreateDeckSnapshot(db *mongo.Database, deck mongo.Deck, name string) (*mongo.DeckSnapshot, error) {
+	cards, err := LoadCards(db, []primitive.ObjectID{deck.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	repetitions := []*mongo.Repetition{}
+	err = db.Repetitions.FindAll(bson.M{
+		"deckId": deck.ID,
+		"userId": nil,
+	}, &repetitions)
+	if err != nil {
+		return nil, err
+	}
+
+	content := mongo.SnapshotContent{
+		Cards:       cards,
+		Repetitions: make([]mongo.Repetition, len(repetitions)),
+	}
+	for i, repetition := range repetitions {
+		content.Repetitions[i] = *repetition
+	}
+	encoded, err := encodeSnapshot(content)
+	if err != nil {
+		return nil, err
+	} else if len(encoded) > MaxSnapshotSize {
+		return nil, ErrSnapshotTooLarge
+	}
+
+	media := []string{}
+	for _, card := range cards {
+		for _, blobID := range CardMedia(card) {
+			if !slices.Contains(media, blobID) {
+				media = append(media, blobID)
+			}
+		}
+	}
+
+	snapshot := &mongo.DeckSnapshot{
+		Deck:        deck.ID,
+		Name:        name,
+		Cards:       len(content.Cards),
+		Repetitions: len(content.Repetitions),
+		Size:        len(encoded),
+		Media:       media,
+		Content:     encoded,
+	}
+	snapshotId, err := db.DeckSnapshots.InsertOne(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.ID = snapshotId
+
+	return snapshot, nil
+}
+
+// DeleteDeckSnapshots deletes the snapshots of the decks and returns the images
+// they referenced, which should be released once the deletion is committed
+func DeleteDeckSnapshots(db *mongo.Database, deckIds []primitive.ObjectID) ([]string, error) {
+	// Load only the list of images, not the content
+	snapshots := []*mongo.DeckSnapshot{}
+	err := db.DeckSnapshots.Aggregate(bson.A{
+		bson.M{string(op.Match): bson.M{"deck": bson.M{string(op.In): deckIds}}},
+		bson.M{string(op.Project): bson.M{"media": 1}},
+	}, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.DeckSnapshots.DeleteMany(bson.M{
+		"deck": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	media := []string{}
+	for _, snapshot := range snapshots {
+		media = append(media, snapshot.Media...)
+	}
+
+	return media, nil
+}
+
+// loadDeckSnapshot loads the snapshot specified in the route, reporting the errors to the client
+func loadDeckSnapshot(c *gin.Context, db *mongo.Database, deck mongo.Deck) (mongo.DeckSnapshot, bool) {
+	var snapshot mongo.DeckSnapshot
+	snapshotId, err := primitive.ObjectIDFromHex(c.Param("snapshotId"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid snapshot id")
+		return snapshot, false
+	}
+
+	exists, err := db.DeckSnapshots.FindOneIfExists(bson.M{
+		"_id":  snapshotId,
+		"deck": deck.ID,
+	}, &snapshot)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to load the snapshot")
+		restLogger.Error(err)
+		return snapshot, false
+	} else if !exists {
+		c.String(http.StatusNotFound, "The specified snapshot does not exist")
+		return snapshot, false
+	}
+
+	return snapshot, true
+}
+
+func setupSnapshotRoutes(r *gin.Engine, db *mongo.Database, storage storage.BlobStorage) {
+	r.POST("/decks/:deckId/snapshots", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// The name is optional
+		var payload struct {
+			Name string `json:"name"`
+		}
+		err := c.ShouldBindJSON(&payload)
+		if err != nil && !errors.Is(err, io.EOF) {
+			c.String(http.StatusBadRequest, "The payload is invalid")
+			return
+		}
+		if payload.Name == "" {
+			payload.Name = time.Now().UTC().Format("2006-01-02 15:04")
+		}
+
+		count, err := db.DeckSnapshots.Count(bson.M{
+			"deck": deck.ID,
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the snapshots")
+			restLogger.Error(err)
+			return
+		} else if count >= MaxDeckSnapshots {
+			c.String(http.StatusConflict, "A deck cannot have more than %d snapshots, delete an old one first", MaxDeckSnapshots)
+			return
+		}
+
+		snapshot, err := CreateDeckSnapshot(db, deck, payload.Name)
+		if errors.Is(err, ErrSnapshotTooLarge) {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the snapshot")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, snapshot)
+	})
+
+	r.GET("/decks/:deckId/snapshots", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		// The content is not needed to list the snapshots
+		snapshots := []*mongo.DeckSnapshot{}
+		err := db.DeckSnapshots.Aggregate(bson.A{
+			bson.M{string(op.Match): bson.M{"deck": deck.ID}},
+			bson.M{string(op.Project): bson.M{"content": 0, "media": 0}},
+			bson.M{string(op.Sort): bson.M{"createdAt": -1}},
+		}, &snapshots)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the snapshots")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, snapshots)
+	})
+
+	// Restoring replaces the cards of the deck and the owner's repetitions with the
+	// ones in the snapshot, the collaborators keep their scheduling state for the
+	// cards that are still in the deck
+	r.POST("/decks/:deckId/snapshots/:snapshotId/restore", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		snapshot, ok := loadDeckSnapshot(c, db, deck)
+		if !ok {
+			return
+		}
+		content, err := decodeSnapshot(snapshot)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to read the snapshot")
+			restLogger.Error(err)
+			return
+		}
+
+		cards, err := LoadCards(db, []primitive.ObjectID{deck.ID})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		// The cards moved to other decks after the snapshot was taken are
+		// restored as new cards, so that the two copies do not share the ID
+		snapshotIds := make([]string, len(content.Cards))
+		for i, card := range content.Cards {
+			snapshotIds[i] = card.ID
+		}
+		movedCards := []*mongo.Card{}
+		err = db.Cards.FindAll(bson.M{
+			"deckId": bson.M{string(op.Ne): deck.ID},
+			"id":     bson.M{string(op.In): snapshotIds},
+		}, &movedCards)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+		newCardIds := map[string]string{}
+		for _, card := range movedCards {
+			newCardIds[card.ID] = uuid.NewString()
+		}
+
+		// The documents are inserted with new object IDs
+		cardIds := []string{}
+		newCards := make([]*mongo.Card, len(content.Cards))
+		for i := range content.Cards {
+			if newCardId, ok := newCardIds[content.Cards[i].ID]; ok {
+				content.Cards[i].ID = newCardId
+			}
+			content.Cards[i].DeckID = deck.ID
+			content.Cards[i].Media = CardMedia(content.Cards[i])
+			newCards[i] = &content.Cards[i]
+			cardIds = append(cardIds, content.Cards[i].ID)
+		}
+		newRepetitions := make([]*mongo.Repetition, len(content.Repetitions))
+		for i := range content.Repetitions {
+			if newCardId, ok := newCardIds[content.Repetitions[i].CardId]; ok {
+				content.Repetitions[i].CardId = newCardId
+			}
+			content.Repetitions[i].DeckID = deck.ID
+			newRepetitions[i] = &content.Repetitions[i]
+		}
+
+		_, err = db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				_, err := db.Cards.DeleteMany(bson.M{
+					"deckId": deck.ID,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				// Delete the repetitions of the owner and the ones of the
+				// collaborators on the cards that are not in the snapshot
+				_, err = db.Repetitions.DeleteMany(bson.M{
+					"deckId": deck.ID,
+					string(op.Or): bson.A{
+						bson.M{"userId": nil},
+						bson.M{"cardId": bson.M{string(op.Nin): cardIds}},
+					},
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				_, err = db.Schedules.DeleteMany(bson.M{
+					"deckId": deck.ID,
+					"cardId": bson.M{string(op.Nin): cardIds},
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				if len(newCards) > 0 {
+					err = db.Cards.InsertMany(newCards)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if len(newRepetitions) > 0 {
+					err = db.Repetitions.InsertMany(newRepetitions)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				return nil, nil
+			},
+		)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to restore the snapshot")
+			restLogger.Error(err)
+			return
+		}
+
+		// Delete the images used only by the replaced cards
+		for _, card := range cards {
+			ReleaseUnusedMedia(db, storage, CardMedia(card))
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	r.DELETE("/decks/:deckId/snapshots/:snapshotId", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.OwnerRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		snapshot, ok := loadDeckSnapshot(c, db, deck)
+		if !ok {
+			return
+		}
+
+		_, err := db.DeckSnapshots.DeleteById(snapshot.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to delete the snapshot")
+			restLogger.Error(err)
+			return
+		}
+
+		ReleaseUnusedMedia(db, storage, snapshot.Media)
+
+		c.String(http.StatusOK, "")
+	})
+}
@@ -0,0 +1,378 @@
+package rest
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// DataExportValidity is how long a data export can be downloaded after it is ready
+const DataExportValidity = 7 * 24 * time.Hour
+
+// DataExportTimeout is the time after which a pending export is considered failed,
+// e.g. because the server was restarted while building it
+const DataExportTimeout = 1 * time.Hour
+
+// DataExportPurgeInterval is how often the expired data exports are deleted
+const DataExportPurgeInterval = 1 * time.Hour
+
+// writeJSONEntry adds a file with the indented JSON encoding of the value to the archive
+func writeJSONEntry(archive *zip.Writer, name string, value interface{}) error {
+	writer, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// WriteDataExport writes a zip archive with the profile of the user, the decks
+// they own with their cards, the repetitions and scheduling state of the user,
+// their subscriptions and the images referenced by their cards
+func WriteDataExport(db *mongo.Database, blobStorage storage.BlobStorage, user mongo.User, w io.Writer) error {
+	decks := []*mongo.Deck{}
+	err := db.Decks.FindAll(bson.M{
+		"owner": user.ID,
+	}, &decks)
+	if err != nil {
+		return err
+	}
+	err = LoadDeckCards(db, decks)
+	if err != nil {
+		return err
+	}
+
+	deckIds := []primitive.ObjectID{}
+	for _, deck := range decks {
+		deckIds = append(deckIds, deck.ID)
+	}
+
+	// The repetitions made by the user are stored without userId on their
+	// own decks and with their userId on the decks of other users
+	repetitions := []*mongo.Repetition{}
+	err = db.Repetitions.FindAll(bson.M{
+		string(op.Or): bson.A{
+			bson.M{
+				"deckId": bson.M{string(op.In): deckIds},
+				"userId": nil,
+			},
+			bson.M{"userId": user.ID},
+		},
+	}, &repetitions)
+	if err != nil {
+		return err
+	}
+
+	schedules := []*mongo.CardSchedule{}
+	err = db.Schedules.FindAll(bson.M{
+		"userId": user.ID,
+	}, &schedules)
+	if err != nil {
+		return err
+	}
+
+	subscriptions := []*mongo.Subscription{}
+	err = db.Subscriptions.FindAll(bson.M{
+		"user": user.ID,
+	}, &subscriptions)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	entries := []struct {
+		name  string
+		value interface{}
+	}{
+		{"profile.json", user},
+		{"decks.json", decks},
+		{"repetitions.json", repetitions},
+		{"schedules.json", schedules},
+		{"subscriptions.json", subscriptions},
+	}
+	for _, entry := range entries {
+		if err := writeJSONEntry(archive, entry.name, entry.value); err != nil {
+			return err
+		}
+	}
+
+	// The cards reference the images by blob ID, which is used as filename
+	media := []string{}
+	for _, deck := range decks {
+		for _, card := range deck.Cards {
+			for _, blobID := range CardMedia(card) {
+				if slices.Contains(media, blobID) {
+					continue
+				}
+
+				reader, exists, err := DownloadMedia(db, blobStorage, *deck, blobID)
+				if err != nil {
+					return err
+				} else if !exists {
+					continue
+				}
+				media = append(media, blobID)
+
+				writer, err := archive.Create("media/" + blobID)
+				if err == nil {
+					_, err = io.Copy(writer, reader)
+				}
+				reader.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+// buildDataExport writes the data export to the blob storage and records its
+// outcome, it is meant to run in the background
+func buildDataExport(db *mongo.Database, blobStorage storage.BlobStorage, user mongo.User, exportId primitive.ObjectID) {
+	blobID := fmt.Sprintf("export-%s.zip", uuid.NewString())
+	size, err := func() (int64, error) {
+		tmp, err := os.CreateTemp("", "binder-export-*.zip")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		err = WriteDataExport(db, blobStorage, user, tmp)
+		if err != nil {
+			return 0, err
+		}
+		size, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+
+		return size, blobStorage.Upload(blobID, tmp)
+	}()
+
+	update := bson.M{}
+	if err != nil {
+		restLogger.Error(err)
+		_ = blobStorage.Delete(blobID)
+		update["status"] = mongo.ExportFailed
+	} else {
+		update["status"] = mongo.ExportReady
+		update["blobId"] = blobID
+		update["size"] = size
+		update["expiresAt"] = time.Now().Add(DataExportValidity)
+	}
+
+	_, err = db.DataExports.UpdateById(exportId, mongo.UpdateDocument{
+		op.Set: update,
+	})
+	if err != nil {
+		restLogger.Error(err)
+	}
+}
+
+// DeleteDataExports deletes the data exports matching the filter and their archives
+func DeleteDataExports(db *mongo.Database, blobStorage storage.BlobStorage, filter bson.M) error {
+	exports := []*mongo.DataExport{}
+	err := db.DataExports.FindAll(filter, &exports)
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if export.BlobID != "" {
+			err = blobStorage.Delete(export.BlobID)
+			if err != nil && !errors.Is(err, storage.ErrBlobNotFound) {
+				return err
+			}
+		}
+
+		_, err = db.DataExports.DeleteById(export.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeExpiredDataExports periodically deletes the data exports that cannot be
+// downloaded anymore and their archives, it runs in the background
+func PurgeExpiredDataExports(db *mongo.Database, blobStorage storage.BlobStorage) {
+	for {
+		err := DeleteDataExports(db, blobStorage, bson.M{
+			"expiresAt": bson.M{string(op.Lt): time.Now()},
+		})
+		if err != nil {
+			restLogger.Error(err)
+		}
+
+		time.Sleep(DataExportPurgeInterval)
+	}
+}
+
+func setupDataExportRoutes(r *gin.Engine, db *mongo.Database, blobStorage storage.BlobStorage) {
+	r.POST("/users/export", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		// Only one export at a time can be built for each user
+		inProgress, err := db.DataExports.Exists(bson.M{
+			"user":      user.ID,
+			"status":    mongo.ExportPending,
+			"createdAt": bson.M{string(op.Gt): time.Now().Add(-DataExportTimeout)},
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the data exports")
+			restLogger.Error(err)
+			return
+		} else if inProgress {
+			c.String(http.StatusConflict, "An export of your data is already in progress")
+			return
+		}
+
+		// The previous exports are replaced by the new one
+		err = DeleteDataExports(db, blobStorage, bson.M{"user": user.ID})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to delete the previous data exports")
+			restLogger.Error(err)
+			return
+		}
+
+		export := &mongo.DataExport{
+			User:   user.ID,
+			Status: mongo.ExportPending,
+		}
+		exportId, err := db.DataExports.InsertOne(export)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the data export")
+			restLogger.Error(err)
+			return
+		}
+		export.ID = exportId
+
+		go buildDataExport(db, blobStorage, user, exportId)
+
+		c.JSON(http.StatusAccepted, export)
+	})
+
+	r.GET("/users/export", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		exports := []*mongo.DataExport{}
+		err = db.DataExports.FindAll(bson.M{
+			"user": user.ID,
+		}, &exports)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the data exports")
+			restLogger.Error(err)
+			return
+		}
+
+		// The exports interrupted by a restart are reported as failed
+		for _, export := range exports {
+			if export.Status == mongo.ExportPending && time.Since(export.CreatedAt) > DataExportTimeout {
+				export.Status = mongo.ExportFailed
+			}
+		}
+		slices.SortFunc(exports, func(a, b *mongo.DataExport) bool {
+			return a.CreatedAt.After(b.CreatedAt)
+		})
+
+		c.JSON(http.StatusOK, exports)
+	})
+
+	r.GET("/users/export/:exportId/download", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		exportId, err := primitive.ObjectIDFromHex(c.Param("exportId"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid export id")
+			return
+		}
+
+		var export mongo.DataExport
+		exists, err = db.DataExports.FindOneIfExists(bson.M{
+			"_id":  exportId,
+			"user": user.ID,
+		}, &export)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the data export")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusNotFound, "The specified data export does not exist")
+			return
+		} else if export.Status != mongo.ExportReady {
+			c.String(http.StatusConflict, "The data export is not ready")
+			return
+		} else if export.ExpiresAt != nil && export.ExpiresAt.Before(time.Now()) {
+			c.String(http.StatusGone, "The data export has expired, request a new one")
+			return
+		}
+
+		properties, err := blobStorage.Properties(export.BlobID)
+		if errors.Is(err, storage.ErrBlobNotFound) {
+			c.String(http.StatusGone, "The data export has expired, request a new one")
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the data export")
+			restLogger.Error(err)
+			return
+		}
+
+		// ServeContent handles the range requests, so interrupted downloads can be resumed
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="binder-export-%s.zip"`, export.CreatedAt.Format("2006-01-02")))
+		content := storage.NewBlobReader(blobStorage, export.BlobID, properties.Size)
+		defer content.Close()
+		http.ServeContent(c.Writer, c.Request, "", properties.LastModified, content)
+	})
+}
@@ -0,0 +1,323 @@
+package rest
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ZaninAndrea/binder-server/internal/cardtext"
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// MaxTextImportSize is the maximum size in bytes of an imported text file or zip archive
+const MaxTextImportSize = 100 * 1024 * 1024
+
+// MaxArchiveEntrySize is the maximum decompressed size in bytes of each file
+// read from an imported zip archive
+const MaxArchiveEntrySize = 100 * 1024 * 1024
+
+var ErrArchiveEntryTooLarge error = fmt.Errorf("the archive contains a file larger than %d bytes", MaxArchiveEntrySize)
+
+// textExtensions are the extensions of the files containing the cards in an imported archive
+var textExtensions = []string{".md", ".markdown", ".txt"}
+
+// zipMedia provides the files of a zip archive, referenced by a path relative to a directory
+type zipMedia struct {
+	files map[string]*zip.File
+	dir   string
+}
+
+func (m zipMedia) OpenMedia(name string) (io.ReadCloser, bool, error) {
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	file, ok := m.files[path.Join(m.dir, name)]
+	if !ok {
+		return nil, false, nil
+	} else if file.UncompressedSize64 > MaxArchiveEntrySize {
+		return nil, true, ErrArchiveEntryTooLarge
+	}
+
+	// The zip reader fails if the entry decompresses to more than its declared size
+	reader, err := file.Open()
+	return reader, true, err
+}
+
+// noMedia is the source of the images of a text file uploaded without an archive
+type noMedia struct{}
+
+func (noMedia) OpenMedia(name string) (io.ReadCloser, bool, error) {
+	return nil, false, nil
+}
+
+// readTextArchive returns the content of the text file contained in the archive, the
+// one closest to the root is used, and the source of the images it references
+func readTextArchive(archive *zip.Reader) (string, MediaSource, error) {
+	files := map[string]*zip.File{}
+	candidates := []string{}
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		files[name] = file
+
+		extension := strings.ToLower(path.Ext(name))
+		if !file.FileInfo().IsDir() && !strings.HasPrefix(name, "__MACOSX/") && slices.Contains(textExtensions, extension) {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil, fmt.Errorf("the archive does not contain a .md or .txt file")
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		depthI, depthJ := strings.Count(candidates[i], "/"), strings.Count(candidates[j], "/")
+		if depthI != depthJ {
+			return depthI < depthJ
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	if files[candidates[0]].UncompressedSize64 > MaxArchiveEntrySize {
+		return "", nil, ErrArchiveEntryTooLarge
+	}
+	reader, err := files[candidates[0]].Open()
+	if err != nil {
+		return "", nil, fmt.Errorf("the archive is corrupted")
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("the archive is corrupted")
+	}
+
+	return string(content), zipMedia{files: files, dir: path.Dir(candidates[0])}, nil
+}
+
+func setupTextRoutes(r *gin.Engine, db *mongo.Database, blobStorage storage.BlobStorage) {
+	// The deck is exported as a Markdown file, or as a zip archive containing
+	// the Markdown file and a media folder if the cards contain images
+	r.GET("/decks/:deckId/export.md", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.PublicRole), func(c *gin.Context) {
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		cards, err := LoadCards(db, []primitive.ObjectID{deck.ID})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the cards")
+			restLogger.Error(err)
+			return
+		}
+
+		media := []string{}
+		textCards := make([]cardtext.Card, len(cards))
+		for i, card := range cards {
+			front, frontMedia, err := ExportMediaFiles(card.Front, "media")
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to export the cards")
+				restLogger.Error(err)
+				return
+			}
+			back, backMedia, err := ExportMediaFiles(card.Back, "media")
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to export the cards")
+				restLogger.Error(err)
+				return
+			}
+			for _, blobID := range append(frontMedia, backMedia...) {
+				if !slices.Contains(media, blobID) {
+					media = append(media, blobID)
+				}
+			}
+
+			textCards[i] = cardtext.Card{
+				Front: front,
+				Back:  back,
+				Tags:  card.Tags,
+			}
+		}
+		text := cardtext.Format(textCards)
+		filename := exportFilename(deck.Name)
+
+		if len(media) == 0 {
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.md"`, filename))
+			c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(text))
+			return
+		}
+
+		// Write the archive to a temporary file, so that failures can still be reported
+		tmp, err := os.CreateTemp("", "binder-md-*.zip")
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the archive")
+			restLogger.Error(err)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		archive := zip.NewWriter(tmp)
+		writer, err := archive.Create(filename + ".md")
+		if err == nil {
+			_, err = writer.Write([]byte(text))
+		}
+		for _, blobID := range media {
+			if err != nil {
+				break
+			}
+
+			var reader io.ReadCloser
+			var exists bool
+			reader, exists, err = DownloadMedia(db, blobStorage, deck, blobID)
+			if err != nil {
+				break
+			} else if !exists {
+				continue
+			}
+			writer, err = archive.Create("media/" + blobID)
+			if err == nil {
+				_, err = io.Copy(writer, reader)
+			}
+			reader.Close()
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+		tmp.Close()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to create the archive")
+			restLogger.Error(err)
+			return
+		}
+
+		c.FileAttachment(tmp.Name(), filename+".zip")
+	})
+
+	// The cards are uploaded as a text file, or as a zip archive containing
+	// the text file and the images it references by relative path
+	r.POST("/decks/:deckId/import/text", Authenticated([]string{"user"}), DeckAuthorized(db, mongo.EditorRole), func(c *gin.Context) {
+		user := c.MustGet("user").(mongo.User)
+		deck := c.MustGet("deck").(mongo.Deck)
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxTextImportSize)
+		file, header, err := c.Request.FormFile("file")
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.String(http.StatusRequestEntityTooLarge, "The file cannot be larger than %d bytes", MaxTextImportSize)
+			return
+		} else if err != nil {
+			c.String(http.StatusBadRequest, "The request must contain the file in the `file` field")
+			return
+		}
+		defer file.Close()
+
+		var text string
+		var source MediaSource = noMedia{}
+		if archive, err := zip.NewReader(file, header.Size); err == nil {
+			text, source, err = readTextArchive(archive)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+		} else {
+			content, err := io.ReadAll(file)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Failed to read the file")
+				return
+			}
+			text = string(content)
+		}
+
+		parsed := cardtext.Parse(text)
+		if len(parsed) == 0 {
+			c.String(http.StatusBadRequest, "The file does not contain any card")
+			return
+		} else if len(parsed) > MaxImportCards {
+			c.String(http.StatusBadRequest, "The file cannot contain more than %d cards", MaxImportCards)
+			return
+		}
+
+		// Convert the Markdown, upload the referenced images and then
+		// create the cards with the same pipeline used by the card routes
+		type importResult struct {
+			Line  int    `json:"line"`
+			ID    string `json:"id,omitempty"`
+			Error string `json:"error,omitempty"`
+		}
+		results := make([]importResult, len(parsed))
+		newCards := []*mongo.Card{}
+		uploaded := map[string]string{}
+		userStorage := UserStorage(db, blobStorage, user)
+		for i, item := range parsed {
+			results[i].Line = item.Line
+
+			front, err := cardtext.RenderMarkdown(item.Front)
+			if err != nil {
+				results[i].Error = "Failed to render the Markdown"
+				continue
+			}
+			back, err := cardtext.RenderMarkdown(item.Back)
+			if err != nil {
+				results[i].Error = "Failed to render the Markdown"
+				continue
+			}
+
+			front, err = ReplaceMediaFiles(front, source, userStorage, uploaded)
+			if err == nil {
+				back, err = ReplaceMediaFiles(back, source, userStorage, uploaded)
+			}
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				results[i].Error = "The images exceed the storage quota of your plan"
+				continue
+			} else if errors.Is(err, ErrArchiveEntryTooLarge) {
+				results[i].Error = fmt.Sprintf("The images cannot be larger than %d bytes", MaxArchiveEntrySize)
+				continue
+			} else if err != nil {
+				results[i].Error = "Failed to upload the images"
+				restLogger.Error(err)
+				continue
+			}
+
+			newCard, err := NewCard(deck.ID, front, back, userStorage)
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				results[i].Error = "The images exceed the storage quota of your plan"
+				continue
+			} else if err != nil {
+				results[i].Error = "Failed to replace base64 images with file links"
+				restLogger.Error(err)
+				continue
+			}
+			newCard.Tags = item.Tags
+
+			results[i].ID = newCard.ID
+			newCards = append(newCards, newCard)
+		}
+
+		// The images uploaded for the rejected cards are released too
+		media := []string{}
+		for _, blobID := range uploaded {
+			media = append(media, blobID)
+		}
+		for _, card := range newCards {
+			media = append(media, CardMedia(*card)...)
+		}
+
+		if len(newCards) > 0 {
+			err = db.Cards.InsertMany(newCards)
+			if err != nil {
+				ReleaseUnusedMedia(db, blobStorage, media)
+
+				c.String(http.StatusInternalServerError, "Failed to save cards")
+				restLogger.Error(err)
+				return
+			}
+		}
+		ReleaseUnusedMedia(db, blobStorage, media)
+
+		c.JSON(http.StatusOK, results)
+	})
+}
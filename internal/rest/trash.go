@@ -0,0 +1,529 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultTrashRetention is how long the deleted decks and cards are kept
+// in the trash when TRASH_RETENTION_DAYS is not set
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashPurgeInterval is how often the expired trash items are purged
+const TrashPurgeInterval = 1 * time.Hour
+
+// maxTrashNameLength is the maximum length of the name shown for a trashed card
+const maxTrashNameLength = 100
+
+var ErrTrashedDeckMissing error = fmt.Errorf("the deck of the card was deleted, restore the deck first")
+var ErrCardAlreadyRestored error = fmt.Errorf("the card is already in the deck")
+
+// TrashRetention returns how long the deleted items are kept in the trash,
+// configured in days by the TRASH_RETENTION_DAYS environment variable
+func TrashRetention() time.Duration {
+	value := os.Getenv("TRASH_RETENTION_DAYS")
+	if value == "" {
+		return DefaultTrashRetention
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		restLogger.Warnf("Invalid TRASH_RETENTION_DAYS %q, using the default retention", value)
+		return DefaultTrashRetention
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// trashCardName returns the text of the front of the card, shortened to be listed in the trash
+func trashCardName(card mongo.Card) string {
+	name := []rune(StripHTML(card.Front))
+	if len(name) > maxTrashNameLength {
+		return string(name[:maxTrashNameLength-1]) + "…"
+	}
+
+	return string(name)
+}
+
+// TrashDeck moves the deck and the sub-decks in deckIds to the trash, the other
+// sub-decks are moved to the deck's parent. The cards are left in the cards
+// collection, where they cannot be reached without their deck, so that their
+// images stay referenced. It should be called inside a transaction
+func TrashDeck(db *mongo.Database, deck mongo.Deck, deckIds []primitive.ObjectID, deletedBy primitive.ObjectID) (*mongo.TrashItem, error) {
+	children := []*mongo.Deck{}
+	err := db.Decks.FindAll(bson.M{
+		"parent": deck.ID,
+		"_id":    bson.M{string(op.Nin): deckIds},
+	}, &children)
+	if err != nil {
+		return nil, err
+	}
+
+	reparented := []primitive.ObjectID{}
+	for _, child := range children {
+		reparented = append(reparented, child.ID)
+	}
+	if len(reparented) > 0 {
+		_, err = db.Decks.UpdateMany(bson.M{
+			"_id": bson.M{string(op.In): reparented},
+		}, mongo.UpdateDocument{
+			op.Set: bson.M{
+				"parent": deck.Parent,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	decks := []*mongo.Deck{}
+	err = db.Decks.FindAll(bson.M{
+		"_id": bson.M{string(op.In): deckIds},
+	}, &decks)
+	if err != nil {
+		return nil, err
+	}
+	cardCount, err := db.Cards.Count(bson.M{
+		"deckId": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Decks.DeleteMany(bson.M{
+		"_id": bson.M{string(op.In): deckIds},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	item := &mongo.TrashItem{
+		Type:       mongo.TrashedDeck,
+		Owner:      deck.Owner,
+		DeletedBy:  deletedBy,
+		DeckID:     deck.ID,
+		Name:       deck.Name,
+		CardCount:  int(cardCount),
+		ExpiresAt:  time.Now().Add(TrashRetention()),
+		Decks:      make([]mongo.Deck, len(decks)),
+		Reparented: reparented,
+	}
+	for i, trashed := range decks {
+		item.Decks[i] = *trashed
+	}
+
+	itemId, err := db.Trash.InsertOne(item)
+	if err != nil {
+		return nil, err
+	}
+	item.ID = itemId
+
+	return item, nil
+}
+
+// TrashCard moves the card of the deck to the trash, its repetitions and the
+// scheduling state of the collaborators are kept until the card is purged.
+// It should be called inside a transaction
+func TrashCard(db *mongo.Database, deck mongo.Deck, card mongo.Card, deletedBy primitive.ObjectID) (*mongo.TrashItem, error) {
+	_, err := db.Cards.DeleteById(card.BasicModel.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &mongo.TrashItem{
+		Type:      mongo.TrashedCard,
+		Owner:     deck.Owner,
+		DeletedBy: deletedBy,
+		DeckID:    deck.ID,
+		Name:      trashCardName(card),
+		CardCount: 1,
+		ExpiresAt: time.Now().Add(TrashRetention()),
+		Card:      &card,
+	}
+	itemId, err := db.Trash.InsertOne(item)
+	if err != nil {
+		return nil, err
+	}
+	item.ID = itemId
+
+	return item, nil
+}
+
+// RestoreTrashItem brings the trashed deck or card back, it should be called inside a transaction
+func RestoreTrashItem(db *mongo.Database, item mongo.TrashItem) error {
+	switch item.Type {
+	case mongo.TrashedDeck:
+		trashedIds := []primitive.ObjectID{}
+		for _, deck := range item.Decks {
+			trashedIds = append(trashedIds, deck.ID)
+		}
+
+		var originalParent *primitive.ObjectID
+		for _, deck := range item.Decks {
+			deck := deck
+			if deck.ID == item.DeckID {
+				originalParent = deck.Parent
+			}
+
+			// The deck is moved to the root if its parent was deleted in the meantime
+			if deck.Parent != nil && !slices.Contains(trashedIds, *deck.Parent) {
+				exists, err := db.Decks.Exists(bson.M{"_id": *deck.Parent})
+				if err != nil {
+					return err
+				} else if !exists {
+					deck.Parent = nil
+				}
+			}
+
+			err := db.Decks.RestoreOne(&deck)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Nest again the sub-decks that were moved to the parent and are still there
+		if len(item.Reparented) > 0 {
+			_, err := db.Decks.UpdateMany(bson.M{
+				"_id":    bson.M{string(op.In): item.Reparented},
+				"parent": originalParent,
+			}, mongo.UpdateDocument{
+				op.Set: bson.M{
+					"parent": item.DeckID,
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case mongo.TrashedCard:
+		deckExists, err := db.Decks.Exists(bson.M{"_id": item.DeckID})
+		if err != nil {
+			return err
+		} else if !deckExists {
+			return ErrTrashedDeckMissing
+		}
+
+		cardExists, err := db.Cards.Exists(bson.M{
+			"deckId": item.DeckID,
+			"id":     item.Card.ID,
+		})
+		if err != nil {
+			return err
+		} else if cardExists {
+			return ErrCardAlreadyRestored
+		}
+
+		// The cards trashed before the media field was introduced lack it
+		item.Card.Media = CardMedia(*item.Card)
+		err = db.Cards.RestoreOne(item.Card)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Trash.DeleteById(item.ID)
+	return err
+}
+
+// purgeTrashItem permanently deletes the trashed deck or card and returns the
+// images that may no longer be used, it should be called inside a transaction
+func purgeTrashItem(db *mongo.Database, item mongo.TrashItem) ([]string, error) {
+	media := []string{}
+
+	switch item.Type {
+	case mongo.TrashedDeck:
+		deckIds := []primitive.ObjectID{}
+		for _, deck := range item.Decks {
+			deckIds = append(deckIds, deck.ID)
+		}
+
+		deckMedia, err := DeleteDecks(db, deckIds)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, deckMedia...)
+
+		// The cards trashed from the decks cannot be restored anymore
+		cardItems := []*mongo.TrashItem{}
+		err = db.Trash.FindAll(bson.M{
+			"type":   mongo.TrashedCard,
+			"deckId": bson.M{string(op.In): deckIds},
+		}, &cardItems)
+		if err != nil {
+			return nil, err
+		}
+		for _, cardItem := range cardItems {
+			media = append(media, CardMedia(*cardItem.Card)...)
+		}
+		_, err = db.Trash.DeleteMany(bson.M{
+			"type":   mongo.TrashedCard,
+			"deckId": bson.M{string(op.In): deckIds},
+		})
+		if err != nil {
+			return nil, err
+		}
+	case mongo.TrashedCard:
+		// Restoring a snapshot can bring the card back in the deck, in that
+		// case its repetitions and schedules belong to the live card
+		live, err := db.Cards.Exists(bson.M{
+			"deckId": item.Card.DeckID,
+			"id":     item.Card.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !live {
+			err = DeleteCard(db, *item.Card)
+			if err != nil {
+				return nil, err
+			}
+		}
+		media = append(media, CardMedia(*item.Card)...)
+	}
+
+	_, err := db.Trash.DeleteById(item.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// PurgeTrash permanently deletes the trash items matching the filter and
+// the images that are no longer used
+func PurgeTrash(db *mongo.Database, blobStorage storage.BlobStorage, filter bson.M) error {
+	items := []*mongo.TrashItem{}
+	err := db.Trash.FindAll(filter, &items)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		item := item
+		media, err := db.Transaction(
+			60*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				return purgeTrashItem(db, *item)
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		ReleaseUnusedMedia(db, blobStorage, media.([]string))
+	}
+
+	return nil
+}
+
+// PurgeExpiredTrash periodically purges the expired trash items, it is meant to
+// run in the background for the whole life of the server
+func PurgeExpiredTrash(db *mongo.Database, blobStorage storage.BlobStorage) {
+	for {
+		err := PurgeTrash(db, blobStorage, bson.M{
+			"expiresAt": bson.M{string(op.Lte): time.Now()},
+		})
+		if err != nil {
+			restLogger.Error(err)
+		}
+
+		time.Sleep(TrashPurgeInterval)
+	}
+}
+
+// loadTrashItem loads the trash item specified in the route, if it was deleted
+// by the user or from one of their decks, reporting the errors to the client
+func loadTrashItem(c *gin.Context, db *mongo.Database, user mongo.User) (mongo.TrashItem, bool) {
+	var item mongo.TrashItem
+	itemId, err := primitive.ObjectIDFromHex(c.Param("itemId"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid trash item id")
+		return item, false
+	}
+
+	exists, err := db.Trash.FindOneIfExists(bson.M{
+		"_id": itemId,
+		string(op.Or): bson.A{
+			bson.M{"owner": user.ID},
+			bson.M{"deletedBy": user.ID},
+		},
+	}, &item)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to load the trash")
+		restLogger.Error(err)
+		return item, false
+	} else if !exists {
+		c.String(http.StatusNotFound, "The specified trash item does not exist")
+		return item, false
+	}
+
+	return item, true
+}
+
+func setupTrashRoutes(r *gin.Engine, db *mongo.Database, storage storage.BlobStorage) {
+	// The trash contains the decks and cards deleted by the user and
+	// the ones deleted by the collaborators from the user's decks
+	r.GET("/trash", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		items := []*mongo.TrashItem{}
+		err = db.Trash.FindAll(bson.M{
+			string(op.Or): bson.A{
+				bson.M{"owner": user.ID},
+				bson.M{"deletedBy": user.ID},
+			},
+		}, &items)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the trash")
+			restLogger.Error(err)
+			return
+		}
+		slices.SortFunc(items, func(a, b *mongo.TrashItem) bool {
+			return a.CreatedAt.After(b.CreatedAt)
+		})
+
+		c.JSON(http.StatusOK, items)
+	})
+
+	r.POST("/trash/:itemId/restore", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		item, ok := loadTrashItem(c, db, user)
+		if !ok {
+			return
+		}
+
+		// Decks are restored by their owner, cards by the editors of their deck
+		if item.Type == mongo.TrashedDeck && item.Owner != user.ID {
+			c.String(http.StatusUnauthorized, "Only the owner can restore the deck")
+			return
+		} else if item.Type == mongo.TrashedCard {
+			var deck mongo.Deck
+			exists, err := db.Decks.FindByIdIfExists(item.DeckID, &deck)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the deck")
+				restLogger.Error(err)
+				return
+			} else if !exists {
+				c.String(http.StatusConflict, ErrTrashedDeckMissing.Error())
+				return
+			}
+
+			role, err := DeckRoleOf(db, deck, user.ID)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the deck")
+				restLogger.Error(err)
+				return
+			} else if !role.Includes(mongo.EditorRole) {
+				c.String(http.StatusUnauthorized, "You need the %s role on the deck", mongo.EditorRole)
+				return
+			}
+		}
+
+		_, err = db.Transaction(
+			30*time.Second,
+			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+				return nil, RestoreTrashItem(db, item)
+			},
+		)
+		if errors.Is(err, ErrTrashedDeckMissing) || errors.Is(err, ErrCardAlreadyRestored) {
+			c.String(http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to restore the item")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	// Deleting an item from the trash purges it immediately
+	r.DELETE("/trash/:itemId", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		}
+
+		item, ok := loadTrashItem(c, db, user)
+		if !ok {
+			return
+		}
+
+		// Decks are deleted by their owner, cards by the editors of their deck
+		if item.Type == mongo.TrashedDeck && item.Owner != user.ID {
+			c.String(http.StatusUnauthorized, "Only the owner can delete the deck")
+			return
+		} else if item.Type == mongo.TrashedCard {
+			var deck mongo.Deck
+			exists, err := db.Decks.FindByIdIfExists(item.DeckID, &deck)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to load the deck")
+				restLogger.Error(err)
+				return
+			}
+
+			// The cards of a deck that no longer exists can only be deleted by its owner
+			role := mongo.NoRole
+			if exists {
+				role, err = DeckRoleOf(db, deck, user.ID)
+				if err != nil {
+					c.String(http.StatusInternalServerError, "Failed to load the deck")
+					restLogger.Error(err)
+					return
+				}
+			} else if item.Owner == user.ID {
+				role = mongo.OwnerRole
+			}
+			if !role.Includes(mongo.EditorRole) {
+				c.String(http.StatusUnauthorized, "You need the %s role on the deck", mongo.EditorRole)
+				return
+			}
+		}
+
+		err = PurgeTrash(db, storage, bson.M{"_id": item.ID})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to delete the item")
+			restLogger.Error(err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+}
@@ -1,13 +1,17 @@
 package rest
 
 import (
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/ZaninAndrea/binder-server/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/nbutton23/zxcvbn-go"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -24,7 +28,27 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func setupUserRoutes(r *gin.Engine, db *mongo.Database, jwtSecret []byte) {
+// UserLocation returns the time zone of the user, or UTC if it is invalid
+func UserLocation(user mongo.User) *time.Location {
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		log.Println(err)
+		return time.UTC
+	}
+
+	return location
+}
+
+// UserDay returns the calendar day of the user to which the time belongs,
+// the days of the user end at the EndOfDay hour of their time zone
+func UserDay(user mongo.User, t time.Time) string {
+	return t.
+		Add(-time.Hour * time.Duration(user.EndOfDay)).
+		In(UserLocation(user)).
+		Format("2006-01-02")
+}
+
+func setupUserRoutes(r *gin.Engine, db *mongo.Database, jwtSecret []byte, storage storage.BlobStorage) {
 	r.POST("/users", func(c *gin.Context) {
 		// Parse request
 		var payload struct {
@@ -156,7 +180,13 @@ func setupUserRoutes(r *gin.Engine, db *mongo.Database, jwtSecret []byte) {
 			return
 		}
 
-		c.JSON(200, user)
+		c.JSON(200, struct {
+			mongo.User
+			StorageQuota int64 `json:"storageQuota"`
+		}{
+			User:         user,
+			StorageQuota: user.Plan.StorageQuota(),
+		})
 	})
 
 	r.DELETE("/users", Authenticated([]string{"user"}), func(c *gin.Context) {
@@ -171,10 +201,10 @@ func setupUserRoutes(r *gin.Engine, db *mongo.Database, jwtSecret []byte) {
 		}
 
 		// Delete the user and the associated resources
-		_, err = db.Transaction(
+		media, err := db.Transaction(
 			60*time.Second,
 			func(db *mongo.Database, s mongo.SessionContext) (any, error) {
-				// Delete the deck and the associated repetitions
+				// Delete the decks and the associated repetitions
 				decks := []*mongo.Deck{}
 				err := db.Decks.FindAll(bson.M{
 					"owner": user.ID,
@@ -183,23 +213,84 @@ func setupUserRoutes(r *gin.Engine, db *mongo.Database, jwtSecret []byte) {
 					return nil, err
 				}
 
+				deckIds := []primitive.ObjectID{}
 				for _, deck := range decks {
-					_, err := db.Decks.DeleteById(deck.ID)
+					deckIds = append(deckIds, deck.ID)
+				}
+				media, err := DeleteDecks(db, deckIds)
+				if err != nil {
+					return nil, err
+				}
+
+				// Purge the decks and cards in the trash of the user
+				items := []*mongo.TrashItem{}
+				err = db.Trash.FindAll(bson.M{
+					"owner": user.ID,
+				}, &items)
+				if err != nil {
+					return nil, err
+				}
+				for _, item := range items {
+					itemMedia, err := purgeTrashItem(db, *item)
 					if err != nil {
 						return nil, err
 					}
+					media = append(media, itemMedia...)
+				}
 
-					_, err = db.Repetitions.DeleteMany(bson.M{
-						"deckId": deck.ID,
-					})
+				// Leave the decks shared with the user
+				_, err = db.Decks.UpdateMany(bson.M{
+					"collaborators.user": user.ID,
+				}, mongo.UpdateDocument{
+					op.Pull: bson.M{
+						"collaborators": bson.M{"user": user.ID},
+					},
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				// Cancel the subscriptions to the published decks
+				subscribedIds, err := SubscribedDeckIds(db, user.ID)
+				if err != nil {
+					return nil, err
+				}
+				for _, deckId := range subscribedIds {
+					_, err := Unsubscribe(db, user.ID, deckId)
 					if err != nil {
 						return nil, err
 					}
 				}
 
+				_, err = db.Repetitions.DeleteMany(bson.M{
+					"userId": user.ID,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				_, err = db.Schedules.DeleteMany(bson.M{
+					"userId": user.ID,
+				})
+				if err != nil {
+					return nil, err
+				}
+
 				db.Users.DeleteById(user.ID)
 
-				return nil, nil
+				// Include the uploaded media not used in any card
+				blobs := []*mongo.Blob{}
+				err = db.Blobs.FindAll(bson.M{
+					"owner": user.ID,
+				}, &blobs)
+				if err != nil {
+					return nil, err
+				}
+				for _, blob := range blobs {
+					media = append(media, blob.Name)
+				}
+
+				return media, nil
 			},
 		)
 		if err != nil {
@@ -208,6 +299,12 @@ func setupUserRoutes(r *gin.Engine, db *mongo.Database, jwtSecret []byte) {
 			return
 		}
 
+		ReleaseUnusedMedia(db, storage, media.([]string))
+		err = DeleteDataExports(db, storage, bson.M{"user": user.ID})
+		if err != nil {
+			restLogger.Error(err)
+		}
+
 		c.String(http.StatusOK, "")
 	})
 }
@@ -0,0 +1,235 @@
+package rest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ZaninAndrea/binder-server/internal/mongo"
+	"github.com/ZaninAndrea/binder-server/internal/mongo/op"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultVacationSpreadDays is the number of days over which the due cards
+// are spread after a vacation when the user does not choose it
+const DefaultVacationSpreadDays = 7
+
+// MaxVacationSpreadDays is the maximum number of days over which the due cards can be spread
+const MaxVacationSpreadDays = 60
+
+// VacationDays returns the calendar days of the user from the start of the
+// vacation up to the day before the return
+func VacationDays(user mongo.User, startedAt time.Time, returnedAt time.Time) []string {
+	location := UserLocation(user)
+	shift := -time.Hour * time.Duration(user.EndOfDay)
+	day := startedAt.Add(shift).In(location)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, location)
+	returnDay := UserDay(user, returnedAt)
+
+	days := []string{}
+	for ; day.Format("2006-01-02") < returnDay; day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format("2006-01-02"))
+	}
+
+	return days
+}
+
+// SpreadDueCards spreads the cards that are due for the user over the specified
+// number of days, the most overdue first, by setting their due time. The cards of
+// the first day are left due immediately. It returns the number of due cards
+func SpreadDueCards(db *mongo.Database, user mongo.User, days int, now time.Time) (int, error) {
+	deckIds, err := AccessibleDeckIds(db, user.ID)
+	if err != nil || len(deckIds) == 0 {
+		return 0, err
+	}
+
+	decks := []*mongo.Deck{}
+	err = db.Decks.FindAll(bson.M{
+		"_id": bson.M{string(op.In): deckIds},
+	}, &decks)
+	if err != nil {
+		return 0, err
+	}
+	cards, err := LoadCards(db, deckIds)
+	if err != nil {
+		return 0, err
+	}
+
+	cardsByDeck := map[primitive.ObjectID][]mongo.Card{}
+	for _, card := range cards {
+		cardsByDeck[card.DeckID] = append(cardsByDeck[card.DeckID], card)
+	}
+
+	// Collect the due cards with the user's own scheduling state
+	type dueCard struct {
+		card           mongo.Card
+		schedulingUser *primitive.ObjectID
+		dueAt          time.Time
+	}
+	due := []dueCard{}
+	for _, deck := range decks {
+		deckCards := cardsByDeck[deck.ID]
+		err = ApplyCardSchedules(db, *deck, user.ID, deckCards)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, card := range deckCards {
+			if card.Paused || card.LastRepetition == nil {
+				continue
+			}
+
+			dueAt := card.LastRepetition.Add(time.Duration(card.HalfLife) * time.Millisecond)
+			if card.DueAt != nil {
+				dueAt = *card.DueAt
+			}
+			if dueAt.After(now) {
+				continue
+			}
+
+			due = append(due, dueCard{
+				card:           card,
+				schedulingUser: SchedulingUser(*deck, user.ID),
+				dueAt:          dueAt,
+			})
+		}
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
+	slices.SortFunc(due, func(a, b dueCard) bool {
+		return a.dueAt.Before(b.dueAt)
+	})
+
+	_, err = db.Transaction(
+		60*time.Second,
+		func(db *mongo.Database, s mongo.SessionContext) (any, error) {
+			for i, item := range due {
+				var dueAt *time.Time
+				if day := i * days / len(due); day > 0 {
+					dayDueAt := now.Add(time.Duration(day) * 24 * time.Hour)
+					dueAt = &dayDueAt
+				} else if item.card.DueAt == nil {
+					continue
+				}
+
+				err := SaveCardSchedule(db, item.card, item.schedulingUser, bson.M{
+					"dueAt": dueAt,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return nil, nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(due), nil
+}
+
+func setupVacationRoutes(r *gin.Engine, db *mongo.Database) {
+	r.POST("/users/vacation", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		} else if user.Vacation != nil {
+			c.String(http.StatusConflict, "You are already on vacation")
+			return
+		}
+
+		// The number of days is optional
+		var payload struct {
+			SpreadDays *int `json:"spreadDays"`
+		}
+		err = c.ShouldBindJSON(&payload)
+		if err != nil && !errors.Is(err, io.EOF) {
+			c.String(http.StatusBadRequest, "The payload is invalid")
+			return
+		}
+		spreadDays := DefaultVacationSpreadDays
+		if payload.SpreadDays != nil {
+			spreadDays = *payload.SpreadDays
+		}
+		if spreadDays < 1 || spreadDays > MaxVacationSpreadDays {
+			c.String(http.StatusBadRequest, "The `spreadDays` field must be between 1 and %d", MaxVacationSpreadDays)
+			return
+		}
+
+		vacation := mongo.UserVacation{
+			StartedAt:  time.Now(),
+			SpreadDays: spreadDays,
+		}
+		_, err = db.Users.UpdateById(user.ID, mongo.UpdateDocument{
+			op.Set: bson.M{
+				"vacation": vacation,
+			},
+		})
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to start the vacation")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, vacation)
+	})
+
+	// Returning from the vacation records the vacation days and spreads the due cards
+	r.DELETE("/users/vacation", Authenticated([]string{"user"}), func(c *gin.Context) {
+		// Load user
+		exists, err, user := GetAuthenticatedUser(c, db)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the user")
+			restLogger.Error(err)
+			return
+		} else if !exists {
+			c.String(http.StatusUnauthorized, "The authentication token is associated with a non-existent user")
+			return
+		} else if user.Vacation == nil {
+			c.String(http.StatusConflict, "You are not on vacation")
+			return
+		}
+
+		now := time.Now()
+		dueCards, err := SpreadDueCards(db, user, user.Vacation.SpreadDays, now)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to spread the due cards")
+			restLogger.Error(err)
+			return
+		}
+
+		update := mongo.UpdateDocument{
+			op.Unset: bson.M{
+				"vacation": "",
+			},
+		}
+		if days := VacationDays(user, user.Vacation.StartedAt, now); len(days) > 0 {
+			update[op.AddToSet] = bson.M{
+				"statistics.vacationDays": bson.M{string(op.Each): days},
+			}
+		}
+		_, err = db.Users.UpdateById(user.ID, update)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to end the vacation")
+			restLogger.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, map[string]int{
+			"dueCards": dueCards,
+		})
+	})
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+)
+
+// AzureBlobStorage stores the blobs in a container of an Azure Storage account.
+// The container is expected to be private, clients access the blobs
+// through the SAS-signed URLs generated by SignedURL
+type AzureBlobStorage struct {
+	containerClient *container.Client
+	sharedKey       *azblob.SharedKeyCredential
+	containerName   string
+	accountName     string
+}
+
+func (s *AzureBlobStorage) Upload(filename string, content io.Reader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	blobClient := s.containerClient.NewBlockBlobClient(filename)
+	_, err := blobClient.UploadStream(ctx, content, &azblob.UploadStreamOptions{
+		Concurrency: 8,
+		BlockSize:   8 * 1024 * 1024,
+	})
+	return err
+}
+
+func (s *AzureBlobStorage) DownloadURL(filename string) string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", s.accountName, s.containerName, filename)
+}
+
+// SignedURL returns the blob URL with a read-only SAS token attached,
+// signed with the account shared key
+func (s *AzureBlobStorage) SignedURL(filename string, validity time.Duration) (string, error) {
+	now := time.Now().UTC()
+	query, err := sas.BlobSignatureValues{
+		Protocol:      sas.ProtocolHTTPS,
+		StartTime:     now.Add(-5 * time.Minute),
+		ExpiryTime:    now.Add(validity),
+		Permissions:   (&sas.BlobPermissions{Read: true}).String(),
+		ContainerName: s.containerName,
+		BlobName:      filename,
+	}.SignWithSharedKey(s.sharedKey)
+	if err != nil {
+		return "", err
+	}
+
+	return s.DownloadURL(filename) + "?" + query.Encode(), nil
+}
+
+func (s *AzureBlobStorage) Delete(filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	blobClient := s.containerClient.NewBlockBlobClient(filename)
+	if _, err := blobClient.Delete(ctx, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *AzureBlobStorage) Properties(filename string) (BlobProperties, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	blobClient := s.containerClient.NewBlockBlobClient(filename)
+	res, err := blobClient.GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return BlobProperties{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobProperties{}, err
+	}
+
+	properties := BlobProperties{}
+	if res.ContentLength != nil {
+		properties.Size = *res.ContentLength
+	}
+	if res.ETag != nil {
+		properties.ETag = string(*res.ETag)
+	}
+	if res.LastModified != nil {
+		properties.LastModified = *res.LastModified
+	}
+
+	return properties, nil
+}
+
+func (s *AzureBlobStorage) Download(filename string, offset int64, count int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+
+	blobClient := s.containerClient.NewBlockBlobClient(filename)
+	res, err := blobClient.DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{
+			Offset: offset,
+			Count:  count,
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &cancelReadCloser{ReadCloser: res.Body, cancel: cancel}, nil
+}
+
+func (s *AzureBlobStorage) Exists(filename string) (bool, error) {
+	_, err := s.Properties(filename)
+	if err == ErrBlobNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *AzureBlobStorage) List(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	names := []string{}
+	pager := s.containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: &prefix,
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				names = append(names, *item.Name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+func NewAzureBlobStorage(accountName string, accountKey string, containerName string) (*AzureBlobStorage, error) {
+	sharedKey, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := azblob.NewClientWithSharedKeyCredential(
+		fmt.Sprintf("https://%s.blob.core.windows.net", accountName),
+		sharedKey,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	containerClient := client.ServiceClient().NewContainerClient(containerName)
+
+	return &AzureBlobStorage{
+		containerClient: containerClient,
+		sharedKey:       sharedKey,
+		containerName:   containerName,
+		accountName:     accountName,
+	}, nil
+}
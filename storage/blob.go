@@ -1,70 +1,51 @@
 package storage
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"time"
-
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 )
 
-type BlobStorage struct {
-	containerClient *container.Client
-	sharedKey       *azblob.SharedKeyCredential
-	containerName   string
-	accountName     string
-}
-
-func (s *BlobStorage) Upload(filename string, content io.Reader) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
+// BlobStorage is the interface implemented by all the storage backends
+// used to persist the media (e.g. card images) uploaded by the users
+type BlobStorage interface {
+	// Upload stores the content in a blob with the given name,
+	// overwriting it if it already exists
+	Upload(filename string, content io.Reader) error
 
-	blobClient := s.containerClient.NewBlockBlobClient(filename)
-	_, err := blobClient.UploadStream(ctx, content, &azblob.UploadStreamOptions{
-		Concurrency: 8,
-		BlockSize:   8 * 1024 * 1024,
-	})
-	return err
-}
+	// Delete removes the blob with the given name
+	Delete(filename string) error
 
-func (s *BlobStorage) DownloadURL(filename string) string {
-	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", s.accountName, s.containerName, filename)
-}
+	// DownloadURL returns the URL from which the blob can be downloaded,
+	// the URL only works if the blob is publicly readable
+	DownloadURL(filename string) string
 
-func (s *BlobStorage) Delete(filename string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
+	// SignedURL returns a URL that grants read access to the blob
+	// until the validity period expires
+	SignedURL(filename string, validity time.Duration) (string, error)
 
-	blobClient := s.containerClient.NewBlockBlobClient(filename)
-	if _, err := blobClient.Delete(ctx, nil); err != nil {
-		return err
-	}
+	// Properties returns the size and the version information of the blob,
+	// or ErrBlobNotFound if the blob does not exist
+	Properties(filename string) (BlobProperties, error)
 
-	return nil
-}
+	// Download returns a reader of count bytes of the blob starting
+	// from offset, a count of zero reads until the end of the blob
+	Download(filename string, offset int64, count int64) (io.ReadCloser, error)
 
-func NewBlobStorage(accountName string, accountKey string, containerName string) (*BlobStorage, error) {
-	sharedKey, err := azblob.NewSharedKeyCredential(accountName, accountKey)
-	if err != nil {
-		return nil, err
-	}
+	// Exists checks whether a blob with the given name exists
+	Exists(filename string) (bool, error)
 
-	client, err := azblob.NewClientWithSharedKeyCredential(
-		fmt.Sprintf("https://%s.blob.core.windows.net", accountName),
-		sharedKey,
-		nil,
-	)
-	if err != nil {
-		return nil, err
-	}
-	containerClient := client.ServiceClient().NewContainerClient(containerName)
+	// List returns the names of all the blobs starting with the given prefix
+	List(prefix string) ([]string, error)
+}
 
-	return &BlobStorage{
-		containerClient: containerClient,
-		sharedKey:       sharedKey,
-		containerName:   containerName,
-		accountName:     accountName,
-	}, nil
+// BlobProperties describes the content of a stored blob
+type BlobProperties struct {
+	Size         int64
+	ETag         string
+	LastModified time.Time
 }
+
+var ErrBlobNotFound error = fmt.Errorf("the blob does not exist")
+var ErrInvalidBlobName error = fmt.Errorf("the blob name is invalid")
+var ErrInvalidSignature error = fmt.Errorf("the signature is invalid or expired")
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalBlobStorage stores the blobs as files in a directory of the local
+// filesystem, it is meant to be used during development. The files are
+// served by the handler returned by Handler, which only accepts
+// the URLs generated by SignedURL
+type LocalBlobStorage struct {
+	directory string
+	baseURL   string
+	secret    []byte
+}
+
+// path returns the location of the blob on disk, rejecting the names
+// that would escape the storage directory
+func (s *LocalBlobStorage) path(filename string) (string, error) {
+	if filename == "" || filename != filepath.Base(filename) || filename == ".." {
+		return "", ErrInvalidBlobName
+	}
+
+	return filepath.Join(s.directory, filename), nil
+}
+
+// signature computes the HMAC of the blob name and the expiry timestamp
+func (s *LocalBlobStorage) signature(filename string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(filename + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalBlobStorage) Upload(filename string, content io.Reader) error {
+	path, err := s.path(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (s *LocalBlobStorage) DownloadURL(filename string) string {
+	return s.baseURL + "/" + filename
+}
+
+func (s *LocalBlobStorage) SignedURL(filename string, validity time.Duration) (string, error) {
+	if _, err := s.path(filename); err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(validity).Unix()
+	return s.DownloadURL(filename) +
+		"?expires=" + strconv.FormatInt(expires, 10) +
+		"&signature=" + s.signature(filename, expires), nil
+}
+
+// Verify checks that the expiry timestamp and the signature passed
+// in the query of a signed URL are valid for the given blob
+func (s *LocalBlobStorage) Verify(filename string, rawExpires string, signature string) error {
+	expires, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrInvalidSignature
+	}
+
+	expected := s.signature(filename, expires)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Handler returns an HTTP handler serving the blobs, the request path
+// is expected to be the blob name (e.g. after http.StripPrefix)
+func (s *LocalBlobStorage) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filename := strings.TrimPrefix(r.URL.Path, "/")
+		path, err := s.path(filename)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		if err := s.Verify(filename, query.Get("expires"), query.Get("signature")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		http.ServeFile(w, r, path)
+	})
+}
+
+func (s *LocalBlobStorage) Delete(filename string) error {
+	path, err := s.path(filename)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (s *LocalBlobStorage) Properties(filename string) (BlobProperties, error) {
+	path, err := s.path(filename)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return BlobProperties{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobProperties{}, err
+	}
+
+	return BlobProperties{
+		Size:         info.Size(),
+		ETag:         fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (s *LocalBlobStorage) Download(filename string, offset int64, count int64) (io.ReadCloser, error) {
+	path, err := s.path(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if count <= 0 {
+		return file, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, count), file}, nil
+}
+
+func (s *LocalBlobStorage) Exists(filename string) (bool, error) {
+	path, err := s.path(filename)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *LocalBlobStorage) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// NewLocalBlobStorage creates the storage directory if needed, the secret
+// is used to sign the URLs returned by SignedURL
+func NewLocalBlobStorage(directory string, baseURL string, secret []byte) (*LocalBlobStorage, error) {
+	if err := os.MkdirAll(directory, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStorage{
+		directory: directory,
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		secret:    secret,
+	}, nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// cancelReadCloser releases the context of a download when the body is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// blobReader exposes a blob as an io.ReadSeeker, the content is
+// downloaded lazily starting from the current offset
+type blobReader struct {
+	storage  BlobStorage
+	filename string
+	size     int64
+	offset   int64
+	body     io.ReadCloser
+}
+
+// NewBlobReader returns a reader of the blob that supports seeking,
+// which allows serving range requests with http.ServeContent
+func NewBlobReader(storage BlobStorage, filename string, size int64) io.ReadSeekCloser {
+	return &blobReader{
+		storage:  storage,
+		filename: filename,
+		size:     size,
+	}
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		body, err := r.storage.Download(r.filename, r.offset, 0)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = r.offset + offset
+	case io.SeekEnd:
+		newOffset = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, fmt.Errorf("negative position %d", newOffset)
+	}
+
+	// The open download can only be reused if the position did not change
+	if newOffset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = newOffset
+
+	return newOffset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	return r.body.Close()
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3BlobStorage stores the blobs in a bucket of an S3-compatible
+// object storage (e.g. AWS S3 or MinIO)
+type S3BlobStorage struct {
+	client     *minio.Client
+	bucketName string
+	baseURL    string
+}
+
+func (s *S3BlobStorage) Upload(filename string, content io.Reader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, s.bucketName, filename, content, -1, minio.PutObjectOptions{
+		PartSize: 8 * 1024 * 1024,
+	})
+	return err
+}
+
+func (s *S3BlobStorage) DownloadURL(filename string) string {
+	return fmt.Sprintf("%s/%s/%s", s.baseURL, s.bucketName, filename)
+}
+
+func (s *S3BlobStorage) SignedURL(filename string, validity time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	signedURL, err := s.client.PresignedGetObject(ctx, s.bucketName, filename, validity, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return signedURL.String(), nil
+}
+
+func (s *S3BlobStorage) Delete(filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	return s.client.RemoveObject(ctx, s.bucketName, filename, minio.RemoveObjectOptions{})
+}
+
+func (s *S3BlobStorage) Properties(filename string) (BlobProperties, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	info, err := s.client.StatObject(ctx, s.bucketName, filename, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return BlobProperties{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobProperties{}, err
+	}
+
+	// minio strips the quotes from the ETag, but the HTTP header needs them
+	return BlobProperties{
+		Size:         info.Size,
+		ETag:         `"` + info.ETag + `"`,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+func (s *S3BlobStorage) Download(filename string, offset int64, count int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+
+	opts := minio.GetObjectOptions{}
+	if count > 0 {
+		err := opts.SetRange(offset, offset+count-1)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	} else if offset > 0 {
+		err := opts.SetRange(offset, 0)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	object, err := s.client.GetObject(ctx, s.bucketName, filename, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &cancelReadCloser{ReadCloser: object, cancel: cancel}, nil
+}
+
+func (s *S3BlobStorage) Exists(filename string) (bool, error) {
+	_, err := s.Properties(filename)
+	if err == ErrBlobNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *S3BlobStorage) List(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	names := []string{}
+	objects := s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		names = append(names, object.Key)
+	}
+
+	return names, nil
+}
+
+// NewS3BlobStorage connects to the S3-compatible server at the given endpoint
+// (host and port, without the scheme) and creates the bucket if needed
+func NewS3BlobStorage(endpoint string, accessKey string, secretKey string, bucketName string, useSSL bool) (*S3BlobStorage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		err = client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3BlobStorage{
+		client:     client,
+		bucketName: bucketName,
+		baseURL:    client.EndpointURL().String(),
+	}, nil
+}